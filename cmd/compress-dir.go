@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+type compressDirJob struct {
+	InputPath  string
+	MirrorPath string // Path of the input in the output tree, used for copies
+	OutputBase string // Path of the compressed output without its extension
+}
+
+type compressDirSummary struct {
+	mu             sync.Mutex
+	Compressed     int
+	Skipped        int
+	Failed         int
+	OriginalSize   int64 // Sum of the inputs that were compressed
+	CompressedSize int64 // Sum of their outputs
+}
+
+func (s *compressDirSummary) add(fn func(s *compressDirSummary)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(s)
+}
+
+func runCompressDir(args []string) int {
+	flagSet, configFile := newFlagSet("compress-dir", "compress-dir [flags] -o <output dir> <input dir>")
+	output := flagSet.String("o", "", "Output directory, the input tree is mirrored into it (required)")
+	format := flagSet.String("format", "webp", "Output format (webp, jpeg, png, avif, jxl, gif)")
+	quality := flagSet.Int("quality", 80, "Compression quality 1-100")
+	grayscale := flagSet.Bool("grayscale", false, "Convert to grayscale")
+	copySkipped := flagSet.Bool("copy-skipped", false, "Copy files that do not shrink unchanged, so the output tree is complete")
+	if !parseFlags(flagSet, configFile, args) {
+		return 2
+	}
+
+	if flagSet.NArg() != 1 || *output == "" {
+		flagSet.Usage()
+		return 2
+	}
+	if _, ok := utils.OutputFormats[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: unsupported format %q\n", *format)
+		return 2
+	}
+	if *quality < 1 || *quality > 100 {
+		fmt.Fprintf(os.Stderr, "Error: quality must be between 1 and 100, got %d\n", *quality)
+		return 2
+	}
+	if !reportConfigErrors() {
+		return 1
+	}
+
+	inputDir, err := filepath.Abs(flagSet.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	outputDir, err := filepath.Abs(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	// The walk skips the output tree, so an input inside it would be skipped entirely
+	if relativePath, err := filepath.Rel(outputDir, inputDir); err == nil && relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		fmt.Fprintf(os.Stderr, "Error: input directory %s must not be the output directory or inside it\n", inputDir)
+		return 2
+	}
+
+	startVips()
+	defer vips.Shutdown()
+
+	params := &utils.BhpParams{
+		Format:    *format,
+		Grayscale: *grayscale,
+		Quality:   *quality,
+	}
+
+	start := time.Now()
+	summary := &compressDirSummary{}
+	jobs := make(chan compressDirJob)
+
+	var wg sync.WaitGroup
+	for range utils.BHP_MAX_CONCURRENCY {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				compressDirFile(job, params, *copySkipped, summary)
+			}
+		}()
+	}
+
+	var dirJobs []compressDirJob
+	walkErr := filepath.WalkDir(inputDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			summary.add(func(s *compressDirSummary) { s.Failed++ })
+			return nil
+		}
+
+		if entry.IsDir() {
+			// Do not descend into the output tree if it is inside the input tree
+			if path == outputDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(inputDir, path)
+		if err != nil {
+			return err
+		}
+		dirJobs = append(dirJobs, compressDirJob{InputPath: path, MirrorPath: filepath.Join(outputDir, relativePath)})
+		return nil
+	})
+
+	// Every path a job may write is reserved before it is queued, so no two
+	// workers write the same file. Copies keep their name, so with -copy-skipped
+	// the mirror paths are reserved first.
+	reservedPaths := map[string]bool{}
+	if *copySkipped {
+		for _, job := range dirJobs {
+			reservedPaths[job.MirrorPath] = true
+		}
+	}
+	for _, job := range dirJobs {
+		job.OutputBase = reserveOutputBase(reservedPaths, job.MirrorPath, *copySkipped)
+		jobs <- job
+	}
+	close(jobs)
+	wg.Wait()
+
+	if walkErr != nil {
+		fmt.Fprintln(os.Stderr, "Error walking input directory:", walkErr)
+	}
+
+	savedSize := summary.OriginalSize - summary.CompressedSize
+	fmt.Println("> Summary:")
+	fmt.Println(" > Elapsed:", time.Since(start).Round(time.Millisecond))
+	fmt.Println(" > Compressed files:", summary.Compressed)
+	fmt.Println(" > Skipped files:", summary.Skipped)
+	fmt.Println(" > Failed files:", summary.Failed)
+	fmt.Println(" > Original size:", utils.FormatSize(summary.OriginalSize))
+	fmt.Printf(" > Compressed size: %s ( %.2f%% )\n", utils.FormatSize(summary.CompressedSize), utils.CalcPercentage(summary.CompressedSize, summary.OriginalSize))
+	fmt.Printf(" > Saved size: %s ( %.2f%% )\n", utils.FormatSize(savedSize), utils.CalcPercentage(savedSize, summary.OriginalSize))
+
+	if walkErr != nil || summary.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// reserveOutputBase returns the path without extension of the compressed output
+// and reserves it with every extension the output may get. It keeps the original
+// extension when another file already produces the same output name, e.g.
+// "photo.png" and "photo.jpg", or "a.png" and the copy of "a.webp".
+func reserveOutputBase(reservedPaths map[string]bool, mirrorPath string, copySkipped bool) string {
+	outputBase := strings.TrimSuffix(mirrorPath, filepath.Ext(mirrorPath))
+	for n := 1; !outputBaseFree(reservedPaths, outputBase, mirrorPath, copySkipped); n++ {
+		outputBase = mirrorPath
+		if n > 1 {
+			outputBase = fmt.Sprintf("%s-%d", mirrorPath, n)
+		}
+	}
+
+	for format := range utils.OutputFormats {
+		reservedPaths[outputBase+"."+formatExtension(format)] = true
+	}
+	return outputBase
+}
+
+// outputBaseFree reports whether none of the outputs of outputBase is reserved,
+// except the file's own copy
+func outputBaseFree(reservedPaths map[string]bool, outputBase string, mirrorPath string, copySkipped bool) bool {
+	for format := range utils.OutputFormats {
+		outputPath := outputBase + "." + formatExtension(format)
+		if reservedPaths[outputPath] && !(copySkipped && outputPath == mirrorPath) {
+			return false
+		}
+	}
+	return true
+}
+
+func compressDirFile(job compressDirJob, params *utils.BhpParams, copySkipped bool, summary *compressDirSummary) {
+	imageBytes, err := os.ReadFile(job.InputPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", job.InputPath, err)
+		summary.add(func(s *compressDirSummary) { s.Failed++ })
+		return
+	}
+
+	imageFormat := utils.DetectImageFormat(imageBytes)
+	if !strings.HasPrefix(imageFormat, "image/") {
+		skipDirFile(job, imageBytes, copySkipped, "not an image ("+http.DetectContentType(imageBytes)+")", summary)
+		return
+	}
+
+	compressedImage, _, err := compressImageBytes(imageBytes, imageFormat, params)
+	if errors.Is(err, errNotSmaller) {
+		skipDirFile(job, imageBytes, copySkipped, err.Error(), summary)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", job.InputPath, err)
+		summary.add(func(s *compressDirSummary) { s.Failed++ })
+		return
+	}
+
+	outputPath := job.OutputBase + "." + formatExtension(compressedImage.Format)
+	if err := writeDirFile(outputPath, compressedImage.Bytes); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", job.InputPath, err)
+		summary.add(func(s *compressDirSummary) { s.Failed++ })
+		return
+	}
+
+	fmt.Printf("%s -> %s: %s -> %s\n", job.InputPath, outputPath,
+		utils.FormatSize(int64(len(imageBytes))), utils.FormatSize(int64(len(compressedImage.Bytes))))
+
+	summary.add(func(s *compressDirSummary) {
+		s.Compressed++
+		s.OriginalSize += int64(len(imageBytes))
+		s.CompressedSize += int64(len(compressedImage.Bytes))
+	})
+}
+
+func skipDirFile(job compressDirJob, fileBytes []byte, copySkipped bool, reason string, summary *compressDirSummary) {
+	fmt.Printf("%s: skipped, %s\n", job.InputPath, reason)
+
+	if copySkipped {
+		if err := writeDirFile(job.MirrorPath, fileBytes); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", job.InputPath, err)
+			summary.add(func(s *compressDirSummary) { s.Failed++ })
+			return
+		}
+	}
+
+	summary.add(func(s *compressDirSummary) { s.Skipped++ })
+}
+
+func writeDirFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestReserveOutputBase(t *testing.T) {
+	tests := []struct {
+		name        string
+		mirrorPaths []string
+		copySkipped bool
+		want        []string
+	}{
+		{name: "distinct names", mirrorPaths: []string{"/out/a.png", "/out/b.jpg"}, want: []string{"/out/a", "/out/b"}},
+		{name: "same name", mirrorPaths: []string{"/out/photo.jpg", "/out/photo.png"}, want: []string{"/out/photo", "/out/photo.png"}},
+		{name: "copy of an output name", mirrorPaths: []string{"/out/a.png", "/out/a.webp"}, copySkipped: true, want: []string{"/out/a.png", "/out/a.webp"}},
+		{name: "own copy", mirrorPaths: []string{"/out/a.webp"}, copySkipped: true, want: []string{"/out/a"}},
+		{name: "kept extension taken too", mirrorPaths: []string{"/out/a.png", "/out/a.jpg", "/out/a.png.webp"}, copySkipped: true, want: []string{"/out/a.png-2", "/out/a.jpg", "/out/a.png"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reservedPaths := map[string]bool{}
+			if test.copySkipped {
+				for _, mirrorPath := range test.mirrorPaths {
+					reservedPaths[filepath.FromSlash(mirrorPath)] = true
+				}
+			}
+			for i, mirrorPath := range test.mirrorPaths {
+				got := reserveOutputBase(reservedPaths, filepath.FromSlash(mirrorPath), test.copySkipped)
+				if want := filepath.FromSlash(test.want[i]); got != want {
+					t.Errorf("reserveOutputBase(%s) = %s, want %s", mirrorPath, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+func runCompress(args []string) int {
+	flagSet, configFile := newFlagSet("compress", "compress [flags] <file|url>...")
+	output := flagSet.String("o", ".", "Output file (single input) or directory")
+	format := flagSet.String("format", "webp", "Output format (webp, jpeg, png, avif, jxl, gif)")
+	quality := flagSet.Int("quality", 80, "Compression quality 1-100")
+	grayscale := flagSet.Bool("grayscale", false, "Convert to grayscale")
+	if !parseFlags(flagSet, configFile, args) {
+		return 2
+	}
+
+	inputs := flagSet.Args()
+	if len(inputs) == 0 {
+		flagSet.Usage()
+		return 2
+	}
+	if _, ok := utils.OutputFormats[*format]; !ok {
+		fmt.Fprintf(os.Stderr, "Error: unsupported format %q\n", *format)
+		return 2
+	}
+	if *quality < 1 || *quality > 100 {
+		fmt.Fprintf(os.Stderr, "Error: quality must be between 1 and 100, got %d\n", *quality)
+		return 2
+	}
+	if !reportConfigErrors() {
+		return 1
+	}
+
+	startVips()
+	defer vips.Shutdown()
+
+	params := &utils.BhpParams{
+		Format:    *format,
+		Grayscale: *grayscale,
+		Quality:   *quality,
+	}
+
+	failed := 0
+	for _, input := range inputs {
+		if err := compressInput(input, *output, len(inputs) > 1, params); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", input, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func compressInput(input string, output string, multipleInputs bool, params *utils.BhpParams) error {
+	var imageBytes []byte
+	var imageFormat string
+
+	if strings.HasPrefix(input, "http://") || strings.HasPrefix(input, "https://") {
+		imageResponse, err := utils.RequestImage(input, http.Header{})
+		if err != nil {
+			return err
+		}
+		if imageResponse.Body != nil {
+			imageResponse.Body.Close()
+			return fmt.Errorf("not an image (content type: %q)", imageResponse.ResponseHeaders.Get("Content-Type"))
+		}
+		imageBytes = imageResponse.Bytes
+		imageFormat = utils.ImageFormatOf(imageResponse.ResponseHeaders.Get("Content-Type"), imageBytes)
+	} else {
+		fileBytes, err := os.ReadFile(input)
+		if err != nil {
+			return err
+		}
+		imageBytes = fileBytes
+		imageFormat = utils.ImageFormatOf(http.DetectContentType(fileBytes), fileBytes)
+	}
+
+	compressedImage, currentQuality, err := compressImageBytes(imageBytes, imageFormat, params)
+	if err != nil {
+		return err
+	}
+	originalImageSize := len(imageBytes)
+
+	outputPath := output
+	if info, err := os.Stat(output); multipleInputs || strings.HasSuffix(output, string(os.PathSeparator)) || (err == nil && info.IsDir()) {
+		outputPath = filepath.Join(output, outputFileName(input, compressedImage.Format))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(outputPath, compressedImage.Bytes, 0o644); err != nil {
+		return err
+	}
+
+	compressedImageSize := len(compressedImage.Bytes)
+	fmt.Printf("%s -> %s (%s, quality %d): %s -> %s ( %.2f%% saved )\n",
+		input, outputPath, compressedImage.Format, currentQuality,
+		utils.FormatSize(int64(originalImageSize)), utils.FormatSize(int64(compressedImageSize)),
+		utils.CalcPercentage(int64(originalImageSize-compressedImageSize), int64(originalImageSize)))
+	return nil
+}
+
+var errNotSmaller = errors.New("could not compress image into smaller size than original")
+
+// compressImageBytes runs the proxy compression pipeline, failing with
+// errNotSmaller like the proxy would redirect, unless BHP_FORCE_FORMAT is set
+func compressImageBytes(imageBytes []byte, imageFormat string, params *utils.BhpParams) (*utils.CompressImageResult, int, error) {
+	compressedImage, currentQuality, err := utils.CompressImageForParams(imageBytes, imageFormat, params)
+	if err != nil {
+		return nil, currentQuality, err
+	}
+
+	if !utils.BHP_FORCE_FORMAT && (compressedImage.Format == "" || len(compressedImage.Bytes) >= len(imageBytes)) {
+		return nil, currentQuality, errNotSmaller
+	}
+
+	return compressedImage, currentQuality, nil
+}
+
+// outputFileName derives the name of the compressed file from the input path or URL
+func outputFileName(input string, format string) string {
+	name := input
+	if index := strings.IndexAny(name, "?#"); index >= 0 {
+		name = name[:index]
+	}
+	name = filepath.Base(strings.TrimRight(name, "/"))
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if name == "" || name == "." || strings.Contains(name, ":") {
+		name = "image"
+	}
+
+	return name + "." + formatExtension(format)
+}
+
+// formatExtension returns the file extension used for an output format
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
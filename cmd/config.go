@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+)
+
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: bandwidth-hero-proxy config check [flags]")
+		return 2
+	}
+
+	flagSet, configFile := newFlagSet("config check", "config check [flags]")
+	if !parseFlags(flagSet, configFile, args[1:]) {
+		return 2
+	}
+
+	fmt.Println("Effective config:")
+	for _, option := range utils.ConfigOptions {
+		fmt.Printf(" > %s: %s\n", option.Name, option.String())
+	}
+
+	if !reportConfigErrors() {
+		return 1
+	}
+
+	fmt.Println("Config OK")
+	return 0
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+)
+
+// headerFlags collects repeated -H "Name: value" flags
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	return ""
+}
+
+func (h headerFlags) Set(value string) error {
+	name, headerValue, found := strings.Cut(value, ":")
+	if !found {
+		return fmt.Errorf("expected \"Name: value\", got %q", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(headerValue))
+	return nil
+}
+
+func runFetch(args []string) int {
+	flagSet, configFile := newFlagSet("fetch", "fetch [flags] <url>")
+	headers := headerFlags{}
+	flagSet.Var(headers, "H", "Client request header to forward, as \"Name: value\" (repeatable)")
+	output := flagSet.String("o", "", "Write the fetched (decompressed) body to this file")
+	if !parseFlags(flagSet, configFile, args) {
+		return 2
+	}
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 2
+	}
+	if !reportConfigErrors() {
+		return 1
+	}
+
+	url := flagSet.Arg(0)
+	fmt.Println("> URL:", url)
+	if utils.BHP_FLARESOLVERR_URL != "" {
+		fmt.Println("> FlareSolverr:", utils.BHP_FLARESOLVERR_URL)
+	}
+
+	start := time.Now()
+	imageResponse, err := utils.RequestImage(url, http.Header(headers))
+	elapsed := time.Since(start)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "> Error after %s: %v\n", elapsed.Round(time.Millisecond), err)
+		return 1
+	}
+
+	fmt.Println("> Request headers:")
+	for _, k := range utils.GetSortedKeys(imageResponse.RequestHeaders) {
+		fmt.Printf(" > %s: %s\n", k, imageResponse.RequestHeaders[k])
+	}
+
+	fmt.Println("> Response headers:")
+	for _, k := range utils.GetSortedKeys(imageResponse.ResponseHeaders) {
+		for _, v := range imageResponse.ResponseHeaders[k] {
+			fmt.Printf(" > %s: %s\n", strings.ToLower(k), v)
+		}
+	}
+
+	// The fetched content is shown even when it is not an image
+	if imageResponse.Body != nil {
+		imageResponse.Bytes, err = io.ReadAll(imageResponse.Body)
+		imageResponse.Body.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "> Error reading response:", err)
+			return 1
+		}
+	}
+
+	contentType := imageResponse.ResponseHeaders.Get("Content-Type")
+	fmt.Println("> Info:")
+	fmt.Println(" > Elapsed:", elapsed.Round(time.Millisecond))
+	fmt.Println(" > Content-Type:", contentType)
+	imageFormat := utils.ImageFormatOf(contentType, imageResponse.Bytes)
+	fmt.Println(" > Detected type:", imageFormat)
+	fmt.Println(" > Animated format:", utils.IsAnimatedFormat(imageFormat))
+	fmt.Printf(" > Decoded size: %s (%d bytes)\n", utils.FormatSize(int64(len(imageResponse.Bytes))), len(imageResponse.Bytes))
+
+	if *output != "" {
+		if err := os.WriteFile(*output, imageResponse.Bytes, 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "Error writing output:", err)
+			return 1
+		}
+		fmt.Println(" > Written to:", *output)
+	}
+
+	return 0
+}
@@ -1,43 +1,124 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
-	"net/http"
+	"os"
+	"strings"
 
 	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
 	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
 )
 
+type command struct {
+	Name        string
+	Description string
+	Run         func(args []string) int
+}
+
+var commands = []command{
+	{"serve", "Run the proxy server (default)", runServe},
+	{"compress", "Compress local files or a URL and write the output", runCompress},
+	{"compress-dir", "Compress every image of a directory into a mirror tree", runCompressDir},
+	{"fetch", "Fetch a URL like the proxy does and print diagnostics", runFetch},
+	{"sign", "Sign a proxy URL with the URL signing key", runSign},
+	{"config", "Configuration helpers (config check)", runConfig},
+	{"version", "Print version information", runVersion},
+}
+
 func main() {
-	log.Println("Starting Bandwidth Hero Proxy...")
-
-	log.Println("> Config:")
-	log.Println(" > BHP_PORT:", utils.BHP_PORT)
-	log.Println(" > BHP_MAX_CONCURRENCY:", utils.BHP_MAX_CONCURRENCY)
-	log.Println(" > BHP_FORCE_FORMAT:", utils.BHP_FORCE_FORMAT)
-	log.Println(" > BHP_AUTO_DECREMENT_QUALITY:", utils.BHP_AUTO_DECREMENT_QUALITY)
-	log.Println(" > BHP_USE_BEST_COMPRESSION_FORMAT:", utils.BHP_USE_BEST_COMPRESSION_FORMAT)
-	log.Println(" > BHP_EXTERNAL_REQUEST_TIMEOUT:", utils.BHP_EXTERNAL_REQUEST_TIMEOUT)
-	log.Println(" > BHP_EXTERNAL_REQUEST_RETRIES:", utils.BHP_EXTERNAL_REQUEST_RETRIES)
-	log.Println(" > BHP_EXTERNAL_REQUEST_REDIRECTS:", utils.BHP_EXTERNAL_REQUEST_REDIRECTS)
-	log.Println(" > BHP_EXTERNAL_REQUEST_OMIT_HEADERS:", utils.BHP_EXTERNAL_REQUEST_OMIT_HEADERS)
-
-	if utils.BHP_FLARESOLVERR_URL != "" {
-		log.Println(" > BHP_FLARESOLVERR_URL:", utils.BHP_FLARESOLVERR_URL)
-		log.Println("Info: BHP_FLARESOLVERR_URL is set, using FlareSolverr to solve any Cloudflare/JS challenge")
-	} else {
-		log.Println(" > BHP_FLARESOLVERR_URL:", "not set")
+	args := os.Args[1:]
+
+	// Without a subcommand (or with only flags) the server is started,
+	// to stay compatible with existing deployments
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name = args[0]
+		args = args[1:]
+	}
+
+	if name == "help" {
+		printUsage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.Name == name {
+			os.Exit(cmd.Run(args))
+		}
 	}
 
-	if utils.BHP_FORCE_FORMAT && utils.BHP_USE_BEST_COMPRESSION_FORMAT {
-		log.Panicln("Error: BHP_FORCE_FORMAT and BHP_USE_BEST_COMPRESSION_FORMAT cannot be both enabled at the same time.")
+	fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	printUsage()
+	os.Exit(2)
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: bandwidth-hero-proxy <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, cmd.Description)
 	}
+	fmt.Fprintln(os.Stderr, "\nRun 'bandwidth-hero-proxy <command> -h' for the flags of a command.")
+}
 
-	if utils.BHP_USE_BEST_COMPRESSION_FORMAT && utils.BHP_AUTO_DECREMENT_QUALITY {
-		log.Panicln("Error: BHP_USE_BEST_COMPRESSION_FORMAT and BHP_AUTO_DECREMENT_QUALITY cannot be both enabled at the same time.")
+// newFlagSet creates the flag set of a command with a flag mirroring every
+// BHP_* option, plus --config to load an env-style config file
+func newFlagSet(name string, usage string) (*flag.FlagSet, *string) {
+	flagSet := flag.NewFlagSet(name, flag.ContinueOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: bandwidth-hero-proxy %s\n\nFlags:\n", usage)
+		flagSet.PrintDefaults()
 	}
 
+	configFile := flagSet.String("config", os.Getenv("BHP_CONFIG_FILE"), "Path of an env-style (KEY=VALUE) config file [BHP_CONFIG_FILE]")
+	for _, option := range utils.ConfigOptions {
+		flagSet.Var(option, option.FlagName(), option.Description+" ["+option.Name+"]")
+	}
+
+	return flagSet, configFile
+}
+
+// parseFlags parses the command line and merges it with the environment and
+// the config file, with the precedence: flags > environment > config file > defaults
+func parseFlags(flagSet *flag.FlagSet, configFile *string, args []string) bool {
+	if err := flagSet.Parse(args); err != nil {
+		return false
+	}
+
+	if *configFile != "" {
+		setByFlag := map[string]bool{}
+		flagSet.Visit(func(f *flag.Flag) {
+			if option, ok := f.Value.(utils.ConfigOption); ok {
+				setByFlag[option.Name] = true
+			}
+		})
+
+		if err := utils.LoadConfigFile(*configFile, setByFlag); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return false
+		}
+	}
+
+	utils.RefreshConfig()
+	return true
+}
+
+// reportConfigErrors prints every configuration error, returning false if any was found
+func reportConfigErrors() bool {
+	errs := utils.ValidateConfig()
+	if len(errs) == 0 {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "Found %d configuration error(s):\n", len(errs))
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, " >", err)
+	}
+	return false
+}
+
+func startVips() {
 	vips.SetLogging(nil, 0) // Suppress vips logs
 	vips.Startup(&vips.Config{
 		ConcurrencyLevel: utils.BHP_MAX_CONCURRENCY, // Set concurrency level to BHP_MAX_CONCURRENCY
@@ -48,21 +129,4 @@ func main() {
 		CacheTrace:       false,                     // Disable cache tracing
 		VectorEnabled:    true,                      // Enable vector support
 	})
-	defer vips.Shutdown()
-
-	mux := http.NewServeMux()
-	mux.HandleFunc("GET /favicon.ico", utils.FaviconHandler)
-	mux.HandleFunc("GET /", utils.ProxyHandler)
-
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", utils.BHP_PORT),
-		Handler: mux,
-	}
-
-	log.Println("Server is running on port", utils.BHP_PORT)
-	if err := server.ListenAndServe(); err != nil {
-		log.Panicln("Error starting server:", err)
-		return
-	}
-	log.Println("Server stopped")
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+func runServe(args []string) int {
+	flagSet, configFile := newFlagSet("serve", "serve [flags]")
+	if !parseFlags(flagSet, configFile, args) {
+		return 2
+	}
+
+	log.Println("Starting Bandwidth Hero Proxy...")
+
+	log.Println("> Config:")
+	for _, option := range utils.ConfigOptions {
+		log.Printf(" > %s: %s\n", option.Name, option.String())
+	}
+
+	if errs := utils.ValidateConfig(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Println("Error:", err)
+		}
+		log.Printf("Found %d configuration error(s), exiting\n", len(errs))
+		return 1
+	}
+
+	if utils.BHP_FLARESOLVERR_URL != "" {
+		log.Println("Info: BHP_FLARESOLVERR_URL is set, using FlareSolverr to solve any Cloudflare/JS challenge")
+	}
+
+	if err := utils.LoadQuotaState(); err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+
+	if err := utils.OpenStats(); err != nil {
+		log.Println("Error:", err)
+		return 1
+	}
+	defer utils.CloseStats()
+
+	startVips()
+	defer vips.Shutdown()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /favicon.ico", utils.FaviconHandler)
+	mux.HandleFunc("GET /", utils.ProxyHandler)
+	if weservPath := strings.TrimRight(utils.BHP_WESERV_PATH_PREFIX, "/"); weservPath != "" {
+		mux.HandleFunc("GET "+weservPath, utils.WeservHandler)
+		mux.HandleFunc("GET "+weservPath+"/", utils.WeservHandler)
+		log.Printf("Info: weserv compatible API is served under %s\n", weservPath)
+	}
+	if utils.BHP_STATS_DB != "" && utils.BHP_STATS_PATH != "" {
+		mux.HandleFunc("GET "+utils.BHP_STATS_PATH, utils.StatsHandler)
+		log.Printf("Info: statistics are served under %s\n", utils.BHP_STATS_PATH)
+	}
+	if adminPath := strings.TrimRight(utils.BHP_ADMIN_PATH_PREFIX, "/"); adminPath != "" {
+		utils.RegisterAdminRoutes(mux)
+		log.Printf("Info: admin dashboard is served under %s/\n", adminPath)
+	}
+
+	server := &http.Server{
+		Handler:   utils.AuthMiddleware(utils.RateLimitMiddleware(utils.MountImgproxy(mux))),
+		Protocols: new(http.Protocols),
+	}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(utils.BHP_H2C)
+	server.RegisterOnShutdown(utils.CloseEventStreams)
+
+	if utils.BHP_IMGPROXY_PATH_PREFIX != "" {
+		log.Printf("Info: imgproxy compatible API is served under %s/\n", strings.TrimRight(utils.BHP_IMGPROXY_PATH_PREFIX, "/"))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if utils.TlsEnabled() {
+		tlsConfig, err := utils.TlsConfig(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+		server.TLSConfig = tlsConfig
+	}
+
+	quotaSaved := make(chan struct{})
+	go func() {
+		utils.PersistQuotaState(ctx)
+		close(quotaSaved)
+	}()
+	go utils.RunStats(ctx)
+
+	listeners, err := utils.OpenListeners()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error starting server:", err)
+		return 1
+	}
+
+	// Every server is shut down gracefully, however it stopped
+	servers := []interface{ Shutdown(context.Context) error }{server}
+	serverErr := make(chan error, 2*len(listeners.Proxy)+3)
+
+	if utils.BHP_HTTP3 {
+		http3Server, udpListeners, err := utils.NewHttp3Server(server.Handler, server.TLSConfig, listeners.Proxy)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error starting server:", err)
+			listeners.Close()
+			return 1
+		}
+		server.Handler = utils.AltSvcMiddleware(server.Handler)
+		servers = append(servers, http3Server)
+		for _, udpListener := range udpListeners {
+			defer udpListener.Close() // Closed after the server is shut down
+			go func() {
+				log.Println("HTTP/3 server is listening on UDP", udpListener.LocalAddr())
+				serverErr <- http3Server.Serve(udpListener)
+			}()
+		}
+	}
+
+	// Decided upfront, because serving plaintext HTTP/2 fills in server.TLSConfig
+	useTls := server.TLSConfig != nil
+	for _, listener := range listeners.Proxy {
+		go func() {
+			if useTls {
+				log.Println("Server is listening on", listener.Addr(), "with TLS")
+				serverErr <- server.ServeTLS(listener, "", "") // The certificate comes from TLSConfig
+				return
+			}
+			log.Println("Server is listening on", listener.Addr())
+			serverErr <- server.Serve(listener)
+		}()
+	}
+
+	if listeners.Admin != nil {
+		adminServer := &http.Server{Handler: utils.AdminApiHandler()}
+		servers = append(servers, adminServer)
+		go func() {
+			log.Println("Admin API is listening on", listeners.Admin.Addr())
+			serverErr <- adminServer.Serve(listeners.Admin)
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case err := <-serverErr:
+		fmt.Fprintln(os.Stderr, "Error starting server:", err)
+		exitCode = 1
+	case <-ctx.Done():
+		log.Println("Shutting down server...")
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for _, runningServer := range servers {
+		if err := runningServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("Error shutting down server:", err)
+		}
+	}
+
+	stop()
+	<-quotaSaved
+	log.Println("Server stopped")
+	return exitCode
+}
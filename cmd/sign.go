@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/internal/utils"
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/pkg/urlsigning"
+)
+
+func runSign(args []string) int {
+	flagSet, configFile := newFlagSet("sign", "sign [flags] <proxy url>")
+	expires := flagSet.Duration("expires", 0, "Lifetime of the signed URL, 0 for no expiry")
+	key := flagSet.String("key", "", "Key to sign with (default: the first of BHP_URL_SIGNING_KEYS)")
+	if !parseFlags(flagSet, configFile, args) {
+		return 2
+	}
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 2
+	}
+
+	signingKey := []byte(*key)
+	if len(signingKey) == 0 {
+		signingKey = utils.UrlSigningKey()
+	}
+	if len(signingKey) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no key given with -key or BHP_URL_SIGNING_KEYS")
+		return 2
+	}
+
+	var expiresAt time.Time
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires)
+	}
+
+	signedUrl, err := urlsigning.SignURL(flagSet.Arg(0), signingKey, expiresAt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+
+	fmt.Println(signedUrl)
+	return 0
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags "-X main.version=<version>"
+var version = "dev"
+
+func runVersion(args []string) int {
+	fmt.Println("bandwidth-hero-proxy", version)
+	fmt.Println(" > Go:", runtime.Version())
+	fmt.Printf(" > Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				fmt.Println(" > Revision:", setting.Value)
+			case "vcs.time":
+				fmt.Println(" > Built from commit at:", setting.Value)
+			case "vcs.modified":
+				if setting.Value == "true" {
+					fmt.Println(" > Modified: true")
+				}
+			}
+		}
+	}
+
+	return 0
+}
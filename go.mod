@@ -7,5 +7,15 @@ require (
 	github.com/cshum/vipsgen v1.3.7
 	github.com/klauspost/compress v1.18.4
 	github.com/pierrec/lz4/v4 v4.1.26
+	github.com/quic-go/quic-go v0.59.1
 	github.com/ulikunitz/xz v0.5.15
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.54.0
+)
+
+require (
+	github.com/quic-go/qpack v0.6.0 // indirect
+	golang.org/x/net v0.56.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
 )
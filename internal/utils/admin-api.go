@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// minAdminTokenLength keeps the admin token from being guessable
+const minAdminTokenLength = 16
+
+type adminConfigOption struct {
+	Name        string `json:"name"`
+	Flag        string `json:"flag"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+// modesUpdate only changes the modes that are present in the request
+type modesUpdate struct {
+	ForceFormat              *bool `json:"force_format"`
+	UseBestCompressionFormat *bool `json:"use_best_compression_format"`
+	AutoDecrementQuality     *bool `json:"auto_decrement_quality"`
+}
+
+func writeAdminJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Error writing admin API response:", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, errs ...error) {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	writeAdminJson(w, status, map[string]any{"errors": messages})
+}
+
+// hasAdminToken reports whether the request carries the "Authorization: Bearer <BHP_ADMIN_TOKEN>" header
+func hasAdminToken(r *http.Request) bool {
+	token, hasToken := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return hasToken && BHP_ADMIN_TOKEN != "" && subtle.ConstantTimeCompare([]byte(token), []byte(BHP_ADMIN_TOKEN)) == 1
+}
+
+// AdminApiHandler serves the runtime control API of the admin listener (BHP_ADMIN_ADDR),
+// every request needs the "Authorization: Bearer <BHP_ADMIN_TOKEN>" header
+func AdminApiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", adminConfigHandler)
+	mux.HandleFunc("GET /modes", adminModesHandler)
+	mux.HandleFunc("PATCH /modes", adminUpdateModesHandler)
+	mux.HandleFunc("GET /metrics", MetricsHandler)
+	mux.HandleFunc("DELETE /flaresolverr/sessions", adminClearFlareSolverrHandler)
+	mux.HandleFunc("DELETE /cache", adminPurgeCacheHandler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bandwidth-hero-proxy-admin"`)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("missing or invalid admin token"))
+			log.Printf("\n> Admin request: %s %s\n> Info:\n > Error: Missing or invalid admin token\n > Action: Rejecting request\n", r.Method, r.URL.Path)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// adminConfigHandler lists the effective configuration, with secrets masked
+func adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	modesMu.RLock()
+	options := make([]adminConfigOption, 0, len(ConfigOptions))
+	for _, option := range ConfigOptions {
+		options = append(options, adminConfigOption{
+			Name:        option.Name,
+			Flag:        "-" + option.FlagName(),
+			Value:       option.String(),
+			Description: option.Description,
+		})
+	}
+	modesMu.RUnlock()
+
+	writeAdminJson(w, http.StatusOK, options)
+}
+
+func adminModesHandler(w http.ResponseWriter, r *http.Request) {
+	writeAdminJson(w, http.StatusOK, CurrentModes())
+}
+
+func adminUpdateModesHandler(w http.ResponseWriter, r *http.Request) {
+	var update modesUpdate
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	modes := CurrentModes()
+	if update.ForceFormat != nil {
+		modes.ForceFormat = *update.ForceFormat
+	}
+	if update.UseBestCompressionFormat != nil {
+		modes.UseBestCompressionFormat = *update.UseBestCompressionFormat
+	}
+	if update.AutoDecrementQuality != nil {
+		modes.AutoDecrementQuality = *update.AutoDecrementQuality
+	}
+
+	if errs := SetModes(modes); len(errs) > 0 {
+		writeAdminError(w, http.StatusConflict, errs...)
+		return
+	}
+
+	log.Printf("\n> Admin request: %s %s\n> Info:\n > Force format: %t\n > Use best compression format: %t\n > Auto decrement quality: %t\n",
+		r.Method, r.URL.Path, modes.ForceFormat, modes.UseBestCompressionFormat, modes.AutoDecrementQuality)
+	writeAdminJson(w, http.StatusOK, modes)
+}
+
+// adminClearFlareSolverrHandler forgets the solved cookies of the "host" query parameter, or of every host
+func adminClearFlareSolverrHandler(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	cleared := ClearFlareSolverrSessions(host)
+
+	log.Printf("\n> Admin request: %s %s\n> Info:\n > Cleared FlareSolverr sessions: %d\n", r.Method, r.URL.RequestURI(), cleared)
+	writeAdminJson(w, http.StatusOK, map[string]int{"cleared": cleared})
+}
+
+// adminPurgeCacheHandler removes the cached images matching the "host" and "prefix"
+// (of the image URL) query parameters, or every cached image
+func adminPurgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	purged := PurgeCache(strings.ToLower(query.Get("host")), query.Get("prefix"))
+
+	log.Printf("\n> Admin request: %s %s\n> Info:\n > Purged cached images: %d\n", r.Method, r.URL.RequestURI(), purged)
+	writeAdminJson(w, http.StatusOK, map[string]int{"purged": purged})
+}
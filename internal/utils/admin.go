@@ -0,0 +1,126 @@
+package utils
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed dashboard/index.html
+var dashboardFS embed.FS
+
+// IsAdmin reports whether the client may use the admin pages: it is listed in
+// BHP_ADMIN_USERS, or sends BHP_ADMIN_TOKEN. Nobody is an admin by default, as
+// behind a local reverse proxy every client would come from the local machine.
+func IsAdmin(r *http.Request) bool {
+	return slices.Contains(BHP_ADMIN_USERS, ClientFromRequest(r).Name) || hasAdminToken(r)
+}
+
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdmin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			RecordFailure("Admin access denied", "Rejecting request")
+			log.Printf("\n> Request: %s\n> Info:\n > Error: Admin access denied for %s\n > Action: Rejecting request\n", r.URL.Path, clientKey(ClientFromRequest(r)))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// isAdminPath reports whether the path is one of the admin pages under BHP_ADMIN_PATH_PREFIX
+func isAdminPath(path string) bool {
+	prefix := strings.TrimRight(BHP_ADMIN_PATH_PREFIX, "/")
+	return prefix != "" && (path == prefix || strings.HasPrefix(path, prefix+"/"))
+}
+
+// RegisterAdminRoutes serves the dashboard and its event stream under BHP_ADMIN_PATH_PREFIX
+func RegisterAdminRoutes(mux *http.ServeMux) {
+	prefix := strings.TrimRight(BHP_ADMIN_PATH_PREFIX, "/")
+	if prefix == "" {
+		return
+	}
+
+	mux.HandleFunc("GET "+prefix, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("GET "+prefix+"/{$}", requireAdmin(DashboardHandler))
+	mux.HandleFunc("GET "+prefix+"/metrics", requireAdmin(MetricsHandler))
+	mux.HandleFunc("GET "+prefix+"/events", requireAdmin(MetricsEventsHandler))
+}
+
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	content, err := dashboardFS.ReadFile("dashboard/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+	if _, err := w.Write(content); err != nil {
+		log.Println("Error writing dashboard response:", err)
+	}
+}
+
+// MetricsHandler serves the live metrics as JSON
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(Metrics()); err != nil {
+		log.Println("Error writing metrics response:", err)
+	}
+}
+
+var (
+	eventStreamsDone     = make(chan struct{})
+	eventStreamsDoneOnce sync.Once
+)
+
+// CloseEventStreams ends the open dashboard event streams, so shutting down does not wait for them
+func CloseEventStreams() {
+	eventStreamsDoneOnce.Do(func() { close(eventStreamsDone) })
+}
+
+// MetricsEventsHandler streams the live metrics as Server-Sent Events every 2 seconds
+func MetricsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Do not let nginx buffer the stream
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		data, err := json.Marshal(Metrics())
+		if err != nil {
+			log.Println("Error encoding metrics:", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-eventStreamsDone:
+			return
+		}
+	}
+}
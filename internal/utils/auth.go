@@ -0,0 +1,320 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type CredentialSettings struct {
+	MinQuality int  // 0 means no lower bound
+	MaxQuality int  // 0 means no upper bound
+	Grayscale  bool // Force grayscale output
+}
+
+// Client identifies who made a request, it is stored in the request context
+type Client struct {
+	Name     string // User name, API key name or IP address
+	Method   string // basic, api-key or ip
+	Settings CredentialSettings
+}
+
+type clientContextKey struct{}
+
+func ContextWithClient(ctx context.Context, client *Client) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+// ClientFromRequest returns the authenticated client, or an anonymous client
+// identified by its IP address when authentication is disabled
+func ClientFromRequest(r *http.Request) *Client {
+	if client, ok := r.Context().Value(clientContextKey{}).(*Client); ok {
+		return client
+	}
+	return &Client{Name: ClientIp(r), Method: "ip"}
+}
+
+type authConfig struct {
+	Users    map[string]string // User name -> bcrypt hash
+	ApiKeys  map[string]string // API key -> name
+	Settings map[string]CredentialSettings
+}
+
+func (config *authConfig) enabled() bool {
+	return len(config.Users) > 0 || len(config.ApiKeys) > 0
+}
+
+func loadAuthConfig() (*authConfig, []error) {
+	config := &authConfig{
+		Users:    map[string]string{},
+		ApiKeys:  map[string]string{},
+		Settings: map[string]CredentialSettings{},
+	}
+	var errs []error
+
+	if BHP_AUTH_HTPASSWD_FILE != "" {
+		content, err := os.ReadFile(BHP_AUTH_HTPASSWD_FILE)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BHP_AUTH_HTPASSWD_FILE: %v", err))
+		}
+
+		for lineNumber, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			user, hash, found := strings.Cut(line, ":")
+			if !found || user == "" {
+				errs = append(errs, fmt.Errorf("BHP_AUTH_HTPASSWD_FILE:%d: expected user:hash", lineNumber+1))
+				continue
+			}
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				errs = append(errs, fmt.Errorf("BHP_AUTH_HTPASSWD_FILE:%d: only bcrypt hashes are supported (htpasswd -B)", lineNumber+1))
+				continue
+			}
+			config.Users[user] = hash
+		}
+	}
+
+	for i, entry := range BHP_AUTH_API_KEYS {
+		name, key, found := strings.Cut(entry, ":")
+		if !found || name == "" || key == "" {
+			errs = append(errs, fmt.Errorf("BHP_AUTH_API_KEYS: entry #%d must be name:key", i+1))
+			continue
+		}
+		config.ApiKeys[key] = name
+	}
+
+	for _, entry := range BHP_AUTH_CREDENTIAL_SETTINGS {
+		name, settings, err := parseCredentialSettings(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BHP_AUTH_CREDENTIAL_SETTINGS: %v", err))
+			continue
+		}
+		config.Settings[name] = settings
+	}
+
+	return config, errs
+}
+
+// parseCredentialSettings parses "name:quality=10-60,grayscale=true"
+func parseCredentialSettings(entry string) (string, CredentialSettings, error) {
+	var settings CredentialSettings
+
+	name, rawSettings, found := strings.Cut(entry, ":")
+	if !found || name == "" {
+		return "", settings, fmt.Errorf("%q must be name:setting=value,...", entry)
+	}
+
+	for _, setting := range strings.Split(rawSettings, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		switch key {
+		case "quality":
+			minValue, maxValue, _ := strings.Cut(value, "-")
+			minQuality, minErr := strconv.Atoi(minValue)
+			maxQuality, maxErr := strconv.Atoi(maxValue)
+			if minErr != nil || maxErr != nil || minQuality < 1 || maxQuality > 100 || minQuality > maxQuality {
+				return "", settings, fmt.Errorf("%s: quality must be a range like 10-60 within 1-100", name)
+			}
+			settings.MinQuality = minQuality
+			settings.MaxQuality = maxQuality
+		case "grayscale":
+			grayscale, err := strconv.ParseBool(value)
+			if err != nil {
+				return "", settings, fmt.Errorf("%s: invalid grayscale value %q", name, value)
+			}
+			settings.Grayscale = grayscale
+		default:
+			return "", settings, fmt.Errorf("%s: unknown setting %q", name, key)
+		}
+	}
+
+	return name, settings, nil
+}
+
+var authConfiguration, authErrors = loadAuthConfig()
+
+// ApplyCredentialSettings restricts the params to what the client is allowed to request
+func ApplyCredentialSettings(bhpParams *BhpParams, client *Client) {
+	settings := client.Settings
+	if settings.MinQuality > 0 && bhpParams.Quality < settings.MinQuality {
+		bhpParams.Quality = settings.MinQuality
+	}
+	if settings.MaxQuality > 0 && bhpParams.Quality > settings.MaxQuality {
+		bhpParams.Quality = settings.MaxQuality
+	}
+	if settings.Grayscale {
+		bhpParams.Grayscale = true
+	}
+}
+
+type authFailures struct {
+	Count       int
+	WindowStart time.Time
+}
+
+var (
+	authFailuresByIp   = map[string]*authFailures{}
+	authFailuresMu     sync.Mutex
+	verifiedPasswords  = map[[sha256.Size]byte]time.Time{}
+	verifiedPasswordMu sync.Mutex
+)
+
+// verifiedPasswordTtl is how long a successful bcrypt check is remembered,
+// so the (intentionally slow) hash is not computed for every image
+const verifiedPasswordTtl = 5 * time.Minute
+
+// AuthMiddleware requires HTTP Basic credentials (from BHP_AUTH_HTPASSWD_FILE)
+// or an API key (from BHP_AUTH_API_KEYS, via the X-API-Key header or the "key"
+// query parameter) when any of them is configured. Clients with too many
+// failed attempts are blocked for BHP_AUTH_FAILURE_WINDOW.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := authConfiguration
+		// The admin token opens the admin pages without proxy credentials
+		if !config.enabled() || r.URL.Path == "/favicon.ico" || (isAdminPath(r.URL.Path) && hasAdminToken(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := ClientIp(r)
+		if retryAfter := authBlockedFor(ip); retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			http.Error(w, "Too many failed authentication attempts", http.StatusTooManyRequests)
+			RecordFailure("Too many failed authentication attempts", "Rejecting request")
+			return
+		}
+
+		client, attempted := authenticate(config, r)
+		if client == nil {
+			if attempted {
+				failures := recordAuthFailure(ip)
+				RecordFailure("Authentication failed", "Rejecting request")
+				log.Printf("\n> Request: %s\n> Info:\n > Error: Authentication failed for %s (%d failed attempt(s))\n > Action: Rejecting request\n",
+					r.URL.Path, ip, failures)
+			}
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="bandwidth-hero-proxy", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		client.Settings = config.Settings[client.Name]
+		next.ServeHTTP(w, r.WithContext(ContextWithClient(r.Context(), client)))
+	})
+}
+
+// authenticate returns the client matching the request credentials, and
+// whether any credentials were presented at all
+func authenticate(config *authConfig, r *http.Request) (*Client, bool) {
+	apiKey := r.Header.Get("X-API-Key")
+	if apiKey == "" {
+		apiKey = r.URL.Query().Get("key")
+	}
+	if apiKey != "" {
+		for key, name := range config.ApiKeys {
+			if subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 {
+				return &Client{Name: name, Method: "api-key"}, true
+			}
+		}
+		return nil, true
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+
+	hash, exists := config.Users[user]
+	if !exists {
+		return nil, true
+	}
+
+	if !verifyPassword(user, password, hash) {
+		return nil, true
+	}
+	return &Client{Name: user, Method: "basic"}, true
+}
+
+func verifyPassword(user string, password string, hash string) bool {
+	cacheKey := sha256.Sum256([]byte(user + "\x00" + password + "\x00" + hash))
+
+	verifiedPasswordMu.Lock()
+	verifiedAt, cached := verifiedPasswords[cacheKey]
+	verifiedPasswordMu.Unlock()
+	if cached && time.Since(verifiedAt) < verifiedPasswordTtl {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+
+	verifiedPasswordMu.Lock()
+	defer verifiedPasswordMu.Unlock()
+	for key, at := range verifiedPasswords {
+		if time.Since(at) >= verifiedPasswordTtl {
+			delete(verifiedPasswords, key)
+		}
+	}
+	verifiedPasswords[cacheKey] = time.Now()
+	return true
+}
+
+func authFailureWindow() time.Duration {
+	window, err := time.ParseDuration(BHP_AUTH_FAILURE_WINDOW)
+	if err != nil {
+		return 15 * time.Minute
+	}
+	return window
+}
+
+// authBlockedFor returns how long the IP address is still blocked for
+func authBlockedFor(ip string) time.Duration {
+	if BHP_AUTH_MAX_FAILURES <= 0 {
+		return 0
+	}
+
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+
+	failures, exists := authFailuresByIp[ip]
+	if !exists || failures.Count < BHP_AUTH_MAX_FAILURES {
+		return 0
+	}
+	return time.Until(failures.WindowStart.Add(authFailureWindow()))
+}
+
+func recordAuthFailure(ip string) int {
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+
+	window := authFailureWindow()
+	now := time.Now()
+
+	// Forget expired windows, so the map does not grow forever
+	for key, failures := range authFailuresByIp {
+		if now.Sub(failures.WindowStart) >= window {
+			delete(authFailuresByIp, key)
+		}
+	}
+
+	failures, exists := authFailuresByIp[ip]
+	if !exists {
+		failures = &authFailures{WindowStart: now}
+		authFailuresByIp[ip] = failures
+	}
+	failures.Count++
+	return failures.Count
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// bestFormatCandidates maps the formats best format selection can choose from to
+// the media type a client must accept for them. Every client accepts JPEG and PNG.
+var bestFormatCandidates = map[string]string{
+	"webp":        "image/webp",
+	"jpeg":        "",
+	"avif":        "image/avif",
+	"jxl":         "image/jxl",
+	"png-palette": "",
+}
+
+// animatedFormats are the candidates animated images keep every frame in. AVIF is
+// left out on purpose, as libvips' heifsave cannot write AVIF image sequences and
+// would keep only the first frame, and JPEG XL animations are rarely supported by
+// browsers, so animated images choose between WebP and a re-optimized GIF.
+var animatedFormats = map[string]bool{"webp": true, "gif": true}
+
+// animatedCandidates keeps the candidates that can hold an animation, and adds GIF
+// which every client can decode
+func animatedCandidates(formats []string) []string {
+	candidates := make([]string, 0, len(formats)+1)
+	for _, format := range formats {
+		if animatedFormats[format] {
+			candidates = append(candidates, format)
+		}
+	}
+	if !slices.Contains(candidates, "gif") {
+		candidates = append(candidates, "gif")
+	}
+	return candidates
+}
+
+func parseBestFormatMinSsim(floor string) (float64, []error) {
+	if floor == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(floor, 64)
+	if err != nil || parsed <= 0 || parsed >= 1 {
+		return 0, []error{fmt.Errorf("BHP_BEST_FORMAT_MIN_SSIM: must be a number between 0 and 1, got %q", floor)}
+	}
+	return parsed, nil
+}
+
+var bestFormatMinSsim, bestFormatMinSsimErrors = parseBestFormatMinSsim(BHP_BEST_FORMAT_MIN_SSIM)
+
+func bestFormatErrors() []error {
+	errs := append([]error{}, bestFormatMinSsimErrors...)
+	if len(BHP_BEST_FORMAT_CANDIDATES) == 0 {
+		errs = append(errs, fmt.Errorf("BHP_BEST_FORMAT_CANDIDATES: at least one format is required"))
+	}
+	for _, format := range BHP_BEST_FORMAT_CANDIDATES {
+		if _, ok := bestFormatCandidates[format]; !ok {
+			errs = append(errs, fmt.Errorf("BHP_BEST_FORMAT_CANDIDATES: unsupported format %q", format))
+		}
+	}
+	return errs
+}
+
+// acceptedMediaTypes returns the media types listed in an Accept header, except
+// the ones refused with q=0
+func acceptedMediaTypes(accept string) map[string]bool {
+	accepted := map[string]bool{}
+	for entry := range strings.SplitSeq(accept, ",") {
+		name, parameters, _ := strings.Cut(entry, ";")
+		refused := false
+		for parameter := range strings.SplitSeq(parameters, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(parameter), "=")
+			if strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+					refused = true
+				}
+			}
+		}
+		if !refused {
+			accepted[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	return accepted
+}
+
+// BestFormatsFor returns the BHP_BEST_FORMAT_CANDIDATES the client can decode
+// according to its Accept header. Formats browsers do not all support, like
+// WebP, AVIF and JPEG XL, must be listed explicitly, wildcards are not enough.
+// Clients without an Accept header get every candidate.
+func BestFormatsFor(accept string) []string {
+	if strings.TrimSpace(accept) == "" {
+		return BHP_BEST_FORMAT_CANDIDATES
+	}
+
+	accepted := acceptedMediaTypes(accept)
+	formats := make([]string, 0, len(BHP_BEST_FORMAT_CANDIDATES))
+	for _, format := range BHP_BEST_FORMAT_CANDIDATES {
+		if mediaType := bestFormatCandidates[format]; mediaType == "" || accepted[mediaType] {
+			formats = append(formats, format)
+		}
+	}
+	if len(formats) == 0 {
+		return []string{"jpeg"}
+	}
+	return formats
+}
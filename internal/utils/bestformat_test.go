@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAnimatedCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		formats []string
+		want    []string
+	}{
+		{name: "WebP and GIF", formats: []string{"avif", "webp", "jxl", "jpeg", "png-palette"}, want: []string{"webp", "gif"}},
+		{name: "AVIF only", formats: []string{"avif", "jpeg"}, want: []string{"gif"}},
+		{name: "GIF already listed", formats: []string{"gif", "webp"}, want: []string{"gif", "webp"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := animatedCandidates(test.formats); !slices.Equal(got, test.want) {
+				t.Errorf("animatedCandidates(%v) = %v, want %v", test.formats, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntryOverhead approximates the memory used by an entry besides its image and key
+const cacheEntryOverhead = 1024
+
+// cachedVariant is a compressed image kept in memory, so it can be served
+// without fetching and encoding it again
+type cachedVariant struct {
+	Key          string
+	Url          string
+	Domain       string
+	Bytes        []byte
+	Header       http.Header // Response headers, except ETag, Cache-Control and Age
+	OriginalSize int
+	Validator    variantValidator
+	UpdatedAt    time.Time // When the entry was stored or last revalidated
+}
+
+func (entry *cachedVariant) size() int64 {
+	return int64(len(entry.Bytes) + len(entry.Key) + cacheEntryOverhead)
+}
+
+var variantCache = struct {
+	sync.Mutex
+	entries      map[string]*list.Element
+	order        *list.List // Most recently used first
+	size         int64
+	revalidating map[string]bool
+}{
+	entries:      map[string]*list.Element{},
+	order:        list.New(),
+	revalidating: map[string]bool{},
+}
+
+var cacheSize, cacheSizeErrors = parseSizeOption("BHP_CACHE_SIZE", BHP_CACHE_SIZE)
+
+// CacheEnabled reports whether compressed images are cached (BHP_CACHE_SIZE)
+func CacheEnabled() bool {
+	return cacheSize > 0
+}
+
+func cacheStaleWhileRevalidate() time.Duration {
+	window, err := time.ParseDuration(BHP_CACHE_STALE_WHILE_REVALIDATE)
+	if err != nil {
+		return 0
+	}
+	return window
+}
+
+func cacheErrors() []error {
+	errs := append([]error{}, cacheSizeErrors...)
+	if window, err := time.ParseDuration(BHP_CACHE_STALE_WHILE_REVALIDATE); err != nil || window < 0 {
+		errs = append(errs, fmt.Errorf("BHP_CACHE_STALE_WHILE_REVALIDATE: invalid duration %q", BHP_CACHE_STALE_WHILE_REVALIDATE))
+	}
+	return errs
+}
+
+// sharedCacheable reports whether the origin allows the image to be shared
+// between clients, private images are never cached. Images fetched with the
+// client's cookies or credentials are only cached when the origin marks them
+// public or gives them an s-maxage, as RFC 9111 requires for Authorization
+func sharedCacheable(requestHeaders map[string]string, upstreamHeaders http.Header) bool {
+	_, _, private, noStore := upstreamFreshness(upstreamHeaders)
+	if private || noStore {
+		return false
+	}
+
+	if requestHeaders["cookie"] == "" && requestHeaders["authorization"] == "" {
+		return true
+	}
+	directives := cacheControlDirectives(upstreamHeaders)
+	_, public := directives["public"]
+	_, sharedMaxAge := directives["s-maxage"]
+	return public || sharedMaxAge
+}
+
+// cachedVariantFor returns a copy of the cached variant, nil when it is not cached
+func cachedVariantFor(key string) *cachedVariant {
+	if !CacheEnabled() {
+		return nil
+	}
+
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	element, exists := variantCache.entries[key]
+	if !exists {
+		return nil
+	}
+	variantCache.order.MoveToFront(element)
+	entry := *element.Value.(*cachedVariant)
+	return &entry
+}
+
+// storeCachedVariant adds or replaces a variant, evicting the least recently used
+// ones to stay within BHP_CACHE_SIZE
+func storeCachedVariant(entry *cachedVariant) {
+	if !CacheEnabled() || entry.size() > cacheSize {
+		return
+	}
+
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	if element, exists := variantCache.entries[entry.Key]; exists {
+		removeCachedElement(element)
+	}
+	variantCache.entries[entry.Key] = variantCache.order.PushFront(entry)
+	variantCache.size += entry.size()
+
+	for variantCache.size > cacheSize {
+		removeCachedElement(variantCache.order.Back())
+	}
+}
+
+// refreshCachedVariant extends the freshness of a variant the origin reported as not modified
+func refreshCachedVariant(key string, validator variantValidator) {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	if element, exists := variantCache.entries[key]; exists {
+		entry := element.Value.(*cachedVariant)
+		entry.Validator = validator
+		entry.UpdatedAt = time.Now()
+	}
+}
+
+// removeCachedElement drops an entry, the cache lock must be held
+func removeCachedElement(element *list.Element) {
+	entry := element.Value.(*cachedVariant)
+	variantCache.order.Remove(element)
+	delete(variantCache.entries, entry.Key)
+	variantCache.size -= entry.size()
+}
+
+func removeCachedVariant(key string) {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	if element, exists := variantCache.entries[key]; exists {
+		removeCachedElement(element)
+	}
+}
+
+// PurgeCache removes the cached images of the host whose URL starts with urlPrefix,
+// empty values match every image, returning how many were removed
+func PurgeCache(host string, urlPrefix string) int {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	purged := 0
+	for element := variantCache.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*cachedVariant)
+		if (host == "" || entry.Domain == host) && strings.HasPrefix(entry.Url, urlPrefix) {
+			removeCachedElement(element)
+			purged++
+		}
+		element = next
+	}
+	return purged
+}
+
+// cacheUsage returns the number of cached images and the memory they use
+func cacheUsage() (int, int64) {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+	return len(variantCache.entries), variantCache.size
+}
+
+// startRevalidation marks the variant as being revalidated in the background,
+// returning false when that already happens
+func startRevalidation(key string) bool {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+
+	if variantCache.revalidating[key] {
+		return false
+	}
+	variantCache.revalidating[key] = true
+	return true
+}
+
+func finishRevalidation(key string) {
+	variantCache.Lock()
+	defer variantCache.Unlock()
+	delete(variantCache.revalidating, key)
+}
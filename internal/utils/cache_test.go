@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSharedCacheable(t *testing.T) {
+	tests := []struct {
+		name           string
+		requestHeaders map[string]string
+		cacheControl   string
+		want           bool
+	}{
+		{name: "anonymous", cacheControl: "max-age=60", want: true},
+		{name: "anonymous without Cache-Control", want: true},
+		{name: "private", cacheControl: "private, max-age=60"},
+		{name: "no-store", cacheControl: "no-store"},
+		{name: "cookie", requestHeaders: map[string]string{"cookie": "session=1"}, cacheControl: "max-age=60"},
+		{name: "authorization", requestHeaders: map[string]string{"authorization": "Basic dTpw"}, cacheControl: "max-age=60"},
+		{name: "cookie on a public image", requestHeaders: map[string]string{"cookie": "session=1"}, cacheControl: "public, max-age=60", want: true},
+		{name: "authorization with s-maxage", requestHeaders: map[string]string{"authorization": "Basic dTpw"}, cacheControl: "s-maxage=60", want: true},
+		{name: "cookie on a public private image", requestHeaders: map[string]string{"cookie": "session=1"}, cacheControl: "public, private"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamHeaders := http.Header{}
+			if test.cacheControl != "" {
+				upstreamHeaders.Set("Cache-Control", test.cacheControl)
+			}
+			if got := sharedCacheable(test.requestHeaders, upstreamHeaders); got != test.want {
+				t.Errorf("sharedCacheable(%v, %q) = %t, want %t", test.requestHeaders, test.cacheControl, got, test.want)
+			}
+		})
+	}
+}
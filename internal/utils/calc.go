@@ -1,6 +1,10 @@
 package utils
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func FormatSize(bytes int64) string {
 	const (
@@ -38,3 +42,45 @@ func CalcPercentage(part, total int64) float64 {
 	}
 	return (float64(part) / float64(total)) * 100
 }
+
+// parseSizeOption parses a size option, empty meaning no limit
+func parseSizeOption(option string, size string) (int64, []error) {
+	if size == "" {
+		return 0, nil
+	}
+	parsed, err := ParseSize(size)
+	if err != nil || parsed < 0 {
+		return 0, []error{fmt.Errorf("%s: invalid size %q", option, size)}
+	}
+	return parsed, nil
+}
+
+// ParseSize parses a byte size like "512", "100KB", "1.5 GB" (binary units)
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	if value == "" {
+		return 0, nil
+	}
+
+	units := []struct {
+		Suffix     string
+		Multiplier float64
+	}{
+		{"PB", 1 << 50}, {"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+	}
+
+	multiplier := 1.0
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.Suffix) {
+			multiplier = unit.Multiplier
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.Suffix))
+			break
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(number * multiplier), nil
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, []error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	var errs []error
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("BHP_TRUSTED_PROXIES: invalid IP address or CIDR %q", proxy))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks, errs
+}
+
+var trustedProxies, trustedProxiesErrors = parseTrustedProxies(BHP_TRUSTED_PROXIES)
+
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIp returns the IP address of the client that made the request.
+// X-Forwarded-For is only honored when the request comes from one of
+// BHP_TRUSTED_PROXIES, the right-most address not belonging to a trusted
+// proxy is the client. Requests over Unix sockets come from a local reverse
+// proxy, so their X-Forwarded-For is always honored.
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	viaUnixSocket := net.ParseIP(host) == nil
+	if !viaUnixSocket && !isTrustedProxy(host) {
+		return host
+	}
+
+	forwardedFor := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwardedFor) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwardedFor[i])
+		if address == "" {
+			continue
+		}
+		if !isTrustedProxy(address) {
+			return address
+		}
+		host = address
+	}
+	return host
+}
@@ -1,12 +1,34 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
 )
 
 func CompressImage(imageBytes []byte, options CompressImageOptions) (*CompressImageResult, error) {
+	vipsImage, err := loadImage(imageBytes, options)
+	if err != nil {
+		return nil, err
+	}
+	defer vipsImage.Close()
+
+	compressedImageBytes, err := encodeImage(vipsImage, options.Format, options.Quality)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompressImageResult(compressedImageBytes, options.Format, options.Quality), nil
+}
+
+// loadImage decodes the image and applies the processing shared by every
+// output format, so it can be encoded several times. It loads from the buffer
+// rather than a vips source: the original is kept whole anyway, to be sent back
+// when the compressed image is not smaller and to hash the variant ETag.
+func loadImage(imageBytes []byte, options CompressImageOptions) (*vips.Image, error) {
 	loadOptions := &vips.LoadOptions{
 		FailOnError: false,
 	}
@@ -21,27 +43,37 @@ func CompressImage(imageBytes []byte, options CompressImageOptions) (*CompressIm
 	if vipsError != nil {
 		return nil, fmt.Errorf("failed to create image from buffer: %w", vipsError)
 	}
-	defer vipsImage.Close()
 
 	vipsImage.RemoveICCProfile()
 
+	if err := ResizeImage(vipsImage, options.Resize); err != nil {
+		vipsImage.Close()
+		return nil, err
+	}
+
 	if options.Grayscale {
 		vipsImage.Colourspace(vips.InterpretationBW, nil)
 	}
 
+	return vipsImage, nil
+}
+
+// encodeImage saves the decoded image in the output format, the image is not modified
+func encodeImage(vipsImage *vips.Image, format string, quality int) ([]byte, error) {
 	var compressedImageBytes []byte
+	var vipsError error
 
-	switch options.Format {
+	switch format {
 	case "webp":
 		compressedImageBytes, vipsError = vipsImage.WebpsaveBuffer(&vips.WebpsaveBufferOptions{
-			Q:        options.Quality,
+			Q:        quality,
 			Lossless: false,
 			Keep:     vips.KeepNone,
 			Effort:   6,
 		})
 	case "jpeg":
 		compressedImageBytes, vipsError = vipsImage.JpegsaveBuffer(&vips.JpegsaveBufferOptions{
-			Q:                  options.Quality,
+			Q:                  quality,
 			OptimizeCoding:     true,
 			OptimizeScans:      true,
 			Keep:               vips.KeepNone,
@@ -51,116 +83,256 @@ func CompressImage(imageBytes []byte, options CompressImageOptions) (*CompressIm
 			OvershootDeringing: true,
 			QuantTable:         3,
 		})
+	case "png":
+		compressedImageBytes, vipsError = vipsImage.PngsaveBuffer(&vips.PngsaveBufferOptions{
+			Compression: 9,
+			Keep:        vips.KeepNone,
+		})
+	case "avif":
+		compressedImageBytes, vipsError = vipsImage.HeifsaveBuffer(&vips.HeifsaveBufferOptions{
+			Q:           quality,
+			Compression: vips.HeifCompressionAv1,
+			Effort:      4,
+			Keep:        vips.KeepNone,
+		})
+	case "jxl":
+		compressedImageBytes, vipsError = vipsImage.JxlsaveBuffer(&vips.JxlsaveBufferOptions{
+			Q:      quality,
+			Effort: 7,
+			Keep:   vips.KeepNone,
+		})
+	case "png-palette":
+		compressedImageBytes, vipsError = vipsImage.PngsaveBuffer(&vips.PngsaveBufferOptions{
+			Compression: 9,
+			Palette:     true,
+			Q:           quality,
+			Effort:      7,
+			Keep:        vips.KeepNone,
+		})
+	case "gif":
+		compressedImageBytes, vipsError = vipsImage.GifsaveBuffer(&vips.GifsaveBufferOptions{
+			Effort: 7,
+			Keep:   vips.KeepNone,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", format)
 	}
 
 	if vipsError != nil {
 		return nil, fmt.Errorf("failed to export image buffer: %w", vipsError)
 	}
+	return compressedImageBytes, nil
+}
+
+// newCompressImageResult records the quality only for formats that have one,
+// encoder variants like png-palette are reported as their format
+func newCompressImageResult(compressedImageBytes []byte, format string, quality int) *CompressImageResult {
+	if !qualityFormats[format] {
+		quality = 0
+	}
+	format, _, _ = strings.Cut(format, "-")
+	return &CompressImageResult{Bytes: compressedImageBytes, Format: format, Quality: quality}
+}
+
+// encodeCandidate encodes the decoded image to one candidate of best format
+// selection, scoring it against the reference when there is one. The result is
+// nil when the quality search finds no quality fitting its target.
+func encodeCandidate(vipsImage *vips.Image, reference *lumaPlane, format string, options CompressImageToBestFormatOptions, originalImageSize int) (*CompressImageResult, error) {
+	quality := options.Quality
+	if options.SearchQuality {
+		result, err := searchQuality(imageEncoder(vipsImage, format), format, options.Quality, qualityTargetSize(originalImageSize))
+		if err != nil || result == nil {
+			return nil, err
+		}
+		if reference == nil {
+			return result, nil
+		}
+		quality = result.Quality // Scored below, encoding it once more
+	}
 
-	return &CompressImageResult{Bytes: compressedImageBytes, Format: options.Format}, nil
+	if reference != nil {
+		return encodeWithSsim(vipsImage, reference, format, quality)
+	}
+	compressedImageBytes, err := encodeImage(vipsImage, format, quality)
+	if err != nil {
+		return nil, err
+	}
+	return newCompressImageResult(compressedImageBytes, format, quality), nil
 }
 
-func CompressImageWithAutoQualityDecrement(imageBytes []byte, options CompressImageWithAutoQualityDecrementOptions) (*CompressImageResult, int, error) {
-	currentQuality := options.InitialQuality
-	var compressedImage *CompressImageResult
-	var err error
+// bestFormatsForParams returns the candidates of best format selection, all of
+// BHP_BEST_FORMAT_CANDIDATES when the client's accepted formats are unknown
+func bestFormatsForParams(params *BhpParams) []string {
+	if len(params.Formats) > 0 {
+		return params.Formats
+	}
+	return BHP_BEST_FORMAT_CANDIDATES
+}
 
-	// Reuse options struct to reduce allocations
-	compressOpts := CompressImageOptions{
+// candidateSlots bounds the candidates encoded at once, by all requests together,
+// to BHP_MAX_CONCURRENCY
+var candidateSlots = make(chan struct{}, max(BHP_MAX_CONCURRENCY, 1))
+
+// CompressImageToBestFormat decodes the image once, encodes it to every candidate
+// format concurrently and returns the smallest output. With SearchQuality, each
+// candidate is encoded at the highest quality fitting the quality search target.
+// With BHP_BEST_FORMAT_MIN_SSIM, outputs scoring below it are not considered.
+// Failing candidates are skipped.
+func CompressImageToBestFormat(imageBytes []byte, options CompressImageToBestFormatOptions) (*CompressImageResult, error) {
+	vipsImage, err := loadImage(imageBytes, CompressImageOptions{
 		InputFormat: options.InputFormat,
-		Format:      options.Format,
+		IsAnimated:  options.IsAnimated,
 		Grayscale:   options.Grayscale,
-		IsAnimated:  false,
+		Resize:      options.Resize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress image: %w", err)
 	}
+	defer vipsImage.Close()
 
-	// Try compressing the image, decreasing quality by 5 each time until we find a smaller size or reach quality - 10
-	for {
-		compressOpts.Quality = currentQuality
-		compressedImage, err = CompressImage(imageBytes, compressOpts)
-		if err != nil {
-			return nil, currentQuality, fmt.Errorf("failed to compress image: %w", err)
+	var reference *lumaPlane
+	if bestFormatMinSsim > 0 && !options.IsAnimated {
+		if reference, err = newLumaPlane(vipsImage); err != nil {
+			return nil, fmt.Errorf("failed to compress image: %w", err)
 		}
+	}
 
-		if len(compressedImage.Bytes) < options.OriginalImageSize {
-			return compressedImage, currentQuality, nil // Return the first compressed image that is smaller than the original
-		}
+	// The decoded image is only read by the encoders, so they share it
+	results := make([]*CompressImageResult, len(options.Formats))
+	errs := make([]error, len(options.Formats))
+	slots := candidateSlots
+	var wg sync.WaitGroup
+	for i, format := range options.Formats {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			results[i], errs[i] = encodeCandidate(vipsImage, reference, format, options, len(imageBytes))
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("%s: %w", format, errs[i])
+			}
+		}()
+	}
+	wg.Wait()
 
-		if currentQuality < options.InitialQuality-10 { // Stop if we've decreased quality by 10
-			// If no compression was better, return the original image
-			return nil, currentQuality, fmt.Errorf("could not compress image into smaller size than original")
+	var best *CompressImageResult
+	failed := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		if result == nil {
+			continue // No quality fits the quality search target
 		}
+		if reference != nil && result.Ssim < bestFormatMinSsim {
+			continue
+		}
+		if len(result.Bytes) < len(imageBytes) && (best == nil || len(result.Bytes) < len(best.Bytes)) {
+			best = result
+		}
+	}
 
-		currentQuality -= 5 // Decrease quality by 5 and try again
+	if best == nil && failed == len(options.Formats) {
+		return nil, fmt.Errorf("failed to compress image: %w", errors.Join(errs...))
+	}
+	if best == nil {
+		return nil, fmt.Errorf("could not compress image into smaller size than original")
 	}
+	return best, nil
 }
 
-// Compress to webp and jpeg concurrently using goroutines
-func CompressImageToBestFormat(imageBytes []byte, options CompressImageToBestFormatOptions) (*CompressImageResult, error) {
-	type result struct {
-		resp *CompressImageResult
-		err  error
+// IsAnimatedImage reports whether the image has several frames. Only the formats
+// that can hold an animation are opened, and libvips reads just their header.
+func IsAnimatedImage(imageBytes []byte, imageFormat string) bool {
+	if !IsAnimatedFormat(imageFormat) {
+		return false
 	}
 
-	webpCh := make(chan result, 1)
-	jpegCh := make(chan result, 1)
-
-	go func() {
-		webpImageBytes, errWebp := CompressImage(imageBytes, CompressImageOptions{
-			Format:      "webp",
-			InputFormat: options.InputFormat,
-			Grayscale:   options.Grayscale,
-			Quality:     options.Quality,
-			IsAnimated:  false,
-		})
-		webpCh <- result{resp: webpImageBytes, err: errWebp}
-	}()
-
-	go func() {
-		jpegImageBytes, errJpeg := CompressImage(imageBytes, CompressImageOptions{
-			Format:      "jpeg",
-			InputFormat: options.InputFormat,
-			Grayscale:   options.Grayscale,
-			Quality:     options.Quality,
-			IsAnimated:  false,
-		})
-		jpegCh <- result{resp: jpegImageBytes, err: errJpeg}
-	}()
-
-	var webpResp, jpegResp *CompressImageResult
-	var errWebp, errJpeg error
-
-	for range 2 {
-		select {
-		case res := <-webpCh:
-			webpResp = res.resp
-			errWebp = res.err
-		case res := <-jpegCh:
-			jpegResp = res.resp
-			errJpeg = res.err
-		}
+	vipsImage, err := vips.NewImageFromBuffer(imageBytes, &vips.LoadOptions{
+		FailOnError: false,
+		N:           -1,
+		Unlimited:   SupportsUnlimited(imageFormat),
+	})
+	if err != nil {
+		return false
 	}
+	defer vipsImage.Close()
+	return vipsImage.Pages() > 1
+}
 
-	if errWebp != nil || errJpeg != nil {
-		return nil, fmt.Errorf("failed to compress image:\n\t%w\n\t%w", errWebp, errJpeg)
+// CompressImageForParams compresses the image with the mode selected by the
+// BHP_* options (SSIM target, best format, auto quality decrement or plain), returning the
+// result and the quality that was used
+func CompressImageForParams(imageBytes []byte, imageFormat string, params *BhpParams) (*CompressImageResult, int, error) {
+	isAnimated := IsAnimatedImage(imageBytes, imageFormat)
+	compressedImage, quality, err := compressImageForParams(imageBytes, imageFormat, isAnimated, params)
+	if compressedImage != nil {
+		compressedImage.Animated = isAnimated
 	}
+	return compressedImage, quality, err
+}
 
-	originalSize := len(imageBytes)
+func compressImageForParams(imageBytes []byte, imageFormat string, isAnimated bool, params *BhpParams) (*CompressImageResult, int, error) {
+	modes := CurrentModes()
 
-	webpSize := 0
-	if webpResp != nil {
-		webpSize = len(webpResp.Bytes)
+	if target := SsimTargetFor(params); target > 0 && !isAnimated {
+		formats := []string{params.Format}
+		if modes.UseBestCompressionFormat {
+			formats = bestFormatsForParams(params)
+		}
+		return CompressImageToSsim(imageBytes, CompressImageToSsimOptions{
+			InputFormat:    imageFormat,
+			Formats:        formats,
+			Grayscale:      params.Grayscale,
+			InitialQuality: params.Quality,
+			Target:         target,
+			Resize:         params.Resize,
+		})
 	}
 
-	jpegSize := 0
-	if jpegResp != nil {
-		jpegSize = len(jpegResp.Bytes)
+	// Both modes apply to animated images too, and compose: the quality is
+	// searched within each candidate format
+	if modes.UseBestCompressionFormat {
+		formats := bestFormatsForParams(params)
+		if isAnimated {
+			formats = animatedCandidates(formats)
+		}
+		compressedImage, err := CompressImageToBestFormat(imageBytes, CompressImageToBestFormatOptions{
+			InputFormat:   imageFormat,
+			IsAnimated:    isAnimated,
+			Formats:       formats,
+			SearchQuality: modes.AutoDecrementQuality,
+			Grayscale:     params.Grayscale,
+			Quality:       params.Quality,
+			Resize:        params.Resize,
+		})
+		if err != nil || compressedImage.Quality == 0 {
+			return compressedImage, params.Quality, err
+		}
+		return compressedImage, compressedImage.Quality, nil
 	}
 
-	if (webpResp != nil && webpSize < originalSize) || (jpegResp != nil && jpegSize < originalSize) {
-		if webpResp != nil && (jpegResp == nil || webpSize < jpegSize) {
-			return webpResp, nil
-		}
-		return jpegResp, nil
+	if modes.AutoDecrementQuality {
+		return CompressImageWithQualitySearch(imageBytes, CompressImageWithQualitySearchOptions{
+			InputFormat:       imageFormat,
+			IsAnimated:        isAnimated,
+			Format:            params.Format,
+			Grayscale:         params.Grayscale,
+			InitialQuality:    params.Quality,
+			OriginalImageSize: len(imageBytes),
+			Resize:            params.Resize,
+		})
 	}
-	return nil, fmt.Errorf("could not compress image into smaller size than original")
+
+	compressedImage, err := CompressImage(imageBytes, CompressImageOptions{
+		InputFormat: imageFormat,
+		IsAnimated:  isAnimated,
+		Format:      params.Format,
+		Grayscale:   params.Grayscale,
+		Quality:     params.Quality,
+		Resize:      params.Resize,
+	})
+	return compressedImage, params.Quality, err
 }
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxVariantValidators bounds the remembered ETags, expired ones are dropped first
+const maxVariantValidators = 10000
+
+// UpstreamValidators are sent to the origin to revalidate an image without downloading it again
+type UpstreamValidators struct {
+	ETag         string
+	LastModified string
+}
+
+func upstreamValidators(upstreamHeaders http.Header) UpstreamValidators {
+	return UpstreamValidators{
+		ETag:         upstreamHeaders.Get("ETag"),
+		LastModified: upstreamHeaders.Get("Last-Modified"),
+	}
+}
+
+// variantValidator is what was served for a variant, so conditional requests
+// can be answered without fetching and encoding the image
+type variantValidator struct {
+	ETag         string
+	CacheControl string
+	FreshUntil   time.Time
+	Upstream     UpstreamValidators
+}
+
+var (
+	variantValidators   = map[string]*variantValidator{}
+	variantValidatorsMu sync.Mutex
+)
+
+// variantKey identifies the output of a request: the image URL and everything
+// that changes how it is processed
+func variantKey(bhpParams *BhpParams, modes CompressionModes) string {
+	key, _ := json.Marshal(struct {
+		Params *BhpParams       `json:"params"`
+		Modes  CompressionModes `json:"modes"`
+	}{bhpParams, modes})
+	return string(key)
+}
+
+// variantETag derives an ETag from the variant and the upstream image. Strong
+// upstream ETags identify the image, otherwise its content is hashed. The ETag is
+// weak when the output depends on timing, like the SSIM search bounded by
+// BHP_SSIM_TIME_BUDGET, so If-Range, which needs a strong match, cannot combine
+// parts of two different outputs.
+func variantETag(key string, upstreamHeaders http.Header, imageBytes []byte, weak bool) string {
+	validator := upstreamHeaders.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		contentHash := sha256.Sum256(imageBytes)
+		validator = hex.EncodeToString(contentHash[:])
+	}
+
+	hash := sha256.Sum256([]byte(key + "\x00" + validator))
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagMatches reports whether the If-None-Match header of the request matches
+// etag, using the weak comparison of RFC 9110
+func etagMatches(r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControlTtls returns BHP_CACHE_CONTROL_MIN_TTL and BHP_CACHE_CONTROL_MAX_TTL
+func cacheControlTtls() (time.Duration, time.Duration) {
+	minTtl, err := time.ParseDuration(BHP_CACHE_CONTROL_MIN_TTL)
+	if err != nil {
+		minTtl = 0
+	}
+	maxTtl, err := time.ParseDuration(BHP_CACHE_CONTROL_MAX_TTL)
+	if err != nil {
+		maxTtl = minTtl
+	}
+	return minTtl, maxTtl
+}
+
+func cacheControlErrors() []error {
+	var errs []error
+
+	minTtl, minErr := time.ParseDuration(BHP_CACHE_CONTROL_MIN_TTL)
+	if minErr != nil || minTtl < 0 {
+		errs = append(errs, fmt.Errorf("BHP_CACHE_CONTROL_MIN_TTL: invalid duration %q", BHP_CACHE_CONTROL_MIN_TTL))
+	}
+	maxTtl, maxErr := time.ParseDuration(BHP_CACHE_CONTROL_MAX_TTL)
+	if maxErr != nil || maxTtl < 0 {
+		errs = append(errs, fmt.Errorf("BHP_CACHE_CONTROL_MAX_TTL: invalid duration %q", BHP_CACHE_CONTROL_MAX_TTL))
+	}
+	if minErr == nil && maxErr == nil && minTtl > maxTtl {
+		errs = append(errs, fmt.Errorf("BHP_CACHE_CONTROL_MIN_TTL: %s is longer than BHP_CACHE_CONTROL_MAX_TTL %s", minTtl, maxTtl))
+	}
+
+	return errs
+}
+
+// upstreamFreshness returns how long the origin allows the image to be cached
+// (s-maxage, max-age or Expires, minus Age), and whether it allows storing it at all
+func upstreamFreshness(upstreamHeaders http.Header) (ttl time.Duration, known bool, private bool, noStore bool) {
+	directives := cacheControlDirectives(upstreamHeaders)
+
+	if _, exists := directives["no-store"]; exists {
+		return 0, true, false, true
+	}
+	_, private = directives["private"]
+
+	if _, exists := directives["no-cache"]; exists {
+		return 0, true, private, false
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if argument, exists := directives[name]; exists {
+			if seconds, err := strconv.ParseInt(argument, 10, 64); err == nil {
+				ttl, known = time.Duration(seconds)*time.Second, true
+				break
+			}
+		}
+	}
+	if !known {
+		if expires, err := http.ParseTime(upstreamHeaders.Get("Expires")); err == nil {
+			date, err := http.ParseTime(upstreamHeaders.Get("Date"))
+			if err != nil {
+				date = time.Now()
+			}
+			ttl, known = expires.Sub(date), true
+		} else if upstreamHeaders.Get("Expires") != "" {
+			ttl, known = 0, true // Invalid dates mean already expired
+		}
+	}
+
+	if age, err := strconv.ParseInt(upstreamHeaders.Get("Age"), 10, 64); err == nil && known {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return max(ttl, 0), known, private, false
+}
+
+// variantCacheControl returns the Cache-Control header of a compressed image and how
+// long it stays fresh: the freshness of the origin clamped into
+// BHP_CACHE_CONTROL_MIN_TTL and BHP_CACHE_CONTROL_MAX_TTL. Images fetched for
+// authenticated clients are private, as their settings may change the output.
+func variantCacheControl(r *http.Request, upstreamHeaders http.Header) (string, time.Duration) {
+	ttl, known, private, noStore := upstreamFreshness(upstreamHeaders)
+	if noStore {
+		return "no-store", 0
+	}
+
+	minTtl, maxTtl := cacheControlTtls()
+	if !known {
+		ttl = minTtl
+	}
+	ttl = min(max(ttl, minTtl), maxTtl)
+
+	visibility := "public"
+	if private || ClientFromRequest(r).Method != "ip" {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int64(ttl.Seconds())), ttl
+}
+
+// cacheControlDirectives returns the Cache-Control directives of the upstream
+// response by lowercase name, with their unquoted argument
+func cacheControlDirectives(upstreamHeaders http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range upstreamHeaders.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+		}
+	}
+	return directives
+}
+
+// rememberedVariant returns what was last served for the variant, nil when nothing was
+func rememberedVariant(key string) *variantValidator {
+	variantValidatorsMu.Lock()
+	defer variantValidatorsMu.Unlock()
+
+	validator, exists := variantValidators[key]
+	if !exists {
+		return nil
+	}
+	remembered := *validator
+	return &remembered
+}
+
+// newVariantValidator describes a variant served with etag from the upstream response
+func newVariantValidator(r *http.Request, etag string, upstreamHeaders http.Header) variantValidator {
+	cacheControl, ttl := variantCacheControl(r, upstreamHeaders)
+	return variantValidator{
+		ETag:         etag,
+		CacheControl: cacheControl,
+		FreshUntil:   time.Now().Add(ttl),
+		Upstream:     upstreamValidators(upstreamHeaders),
+	}
+}
+
+// notModifiedValidator renews a variant the origin reported as not modified,
+// keeping the previous upstream validators when the 304 response has none
+func notModifiedValidator(r *http.Request, upstreamHeaders http.Header, previous variantValidator) variantValidator {
+	validator := newVariantValidator(r, previous.ETag, upstreamHeaders)
+	if validator.Upstream.ETag == "" && validator.Upstream.LastModified == "" {
+		validator.Upstream = previous.Upstream
+	}
+	return validator
+}
+
+// rememberVariant stores the ETag of a variant until it is no longer fresh, and
+// the upstream validators to revalidate it afterwards
+func rememberVariant(key string, validator variantValidator) {
+	if validator.CacheControl == "no-store" {
+		return
+	}
+
+	now := time.Now()
+
+	variantValidatorsMu.Lock()
+	defer variantValidatorsMu.Unlock()
+
+	if _, exists := variantValidators[key]; !exists && len(variantValidators) >= maxVariantValidators {
+		for storedKey, stored := range variantValidators {
+			if now.After(stored.FreshUntil) {
+				delete(variantValidators, storedKey)
+			}
+		}
+		for storedKey := range variantValidators {
+			if len(variantValidators) < maxVariantValidators {
+				break
+			}
+			delete(variantValidators, storedKey)
+		}
+	}
+
+	variantValidators[key] = &validator
+}
+
+// writeNotModified answers a conditional request whose ETag still matches, with
+// the Vary header the image itself is served with
+func writeNotModified(w http.ResponseWriter, bhpParams *BhpParams, etag string, cacheControl string) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", cacheControl)
+	if len(bhpParams.Formats) > 0 {
+		w.Header().Set("Vary", "Accept") // The format was chosen from the formats the client accepts
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVariantETag(t *testing.T) {
+	upstreamHeaders := http.Header{"Etag": {`"v1"`}}
+	strong := variantETag("key", upstreamHeaders, nil, false)
+	weak := variantETag("key", upstreamHeaders, nil, true)
+
+	if strings.HasPrefix(strong, "W/") || weak != "W/"+strong {
+		t.Errorf("variantETag() = %s and %s, want a strong ETag and its weak form", strong, weak)
+	}
+	if variantETag("other key", upstreamHeaders, nil, false) == strong {
+		t.Error("variantETag() is the same for another variant")
+	}
+	if variantETag("key", http.Header{"Etag": {`W/"v1"`}}, []byte("image"), false) == variantETag("key", http.Header{"Etag": {`W/"v1"`}}, []byte("other image"), false) {
+		t.Error("variantETag() with a weak upstream ETag does not depend on the image")
+	}
+
+	for _, etag := range []string{strong, weak} {
+		for _, ifNoneMatch := range []string{strong, weak, `"other", ` + weak, "*"} {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("If-None-Match", ifNoneMatch)
+			if !etagMatches(r, etag) {
+				t.Errorf("etagMatches(If-None-Match: %s, %s) = false, want true", ifNoneMatch, etag)
+			}
+		}
+	}
+}
+
+func TestWriteVariantIfRange(t *testing.T) {
+	strong := variantETag("key", http.Header{"Etag": {`"v1"`}}, nil, false)
+	tests := []struct {
+		name string
+		etag string
+		want int
+	}{
+		{name: "strong ETag", etag: strong, want: http.StatusPartialContent},
+		{name: "weak ETag", etag: "W/" + strong, want: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Range", "bytes=0-3")
+			r.Header.Set("If-Range", test.etag)
+			recorder := httptest.NewRecorder()
+			recorder.Header().Set("ETag", test.etag)
+
+			writeVariant(recorder, r, []byte("compressed image"))
+			if recorder.Code != test.want {
+				t.Errorf("writeVariant() with If-Range: %s = %d, want %d", test.etag, recorder.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteNotModifiedVary(t *testing.T) {
+	tests := []struct {
+		name      string
+		bhpParams BhpParams
+		want      string
+	}{
+		{name: "requested format", bhpParams: BhpParams{Format: "webp"}},
+		{name: "format chosen from Accept", bhpParams: BhpParams{Formats: []string{"avif", "webp", "jpeg"}}, want: "Accept"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			writeNotModified(recorder, &test.bhpParams, `"etag"`, "public, max-age=60")
+			if recorder.Code != http.StatusNotModified || recorder.Header().Get("Vary") != test.want {
+				t.Errorf("writeNotModified() = %d with Vary %q, want %d with Vary %q", recorder.Code, recorder.Header().Get("Vary"), http.StatusNotModified, test.want)
+			}
+		})
+	}
+}
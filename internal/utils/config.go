@@ -0,0 +1,368 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ConfigOption struct {
+	Name        string
+	Description string
+	Value       any // Pointer to the BHP_* variable holding the effective value
+}
+
+// ConfigOptions lists every BHP_* variable in the order they are reported
+var ConfigOptions = []ConfigOption{
+	{"BHP_PORT", "Server port", &BHP_PORT},
+	{"BHP_LISTEN", "Addresses to listen on, like 127.0.0.1:8080, [::1]:8080 or unix:/run/bhp.sock (separated by ';'), empty for all interfaces on BHP_PORT", &BHP_LISTEN},
+	{"BHP_UNIX_SOCKET_MODE", "Octal file mode of the Unix sockets", &BHP_UNIX_SOCKET_MODE},
+	{"BHP_TLS_CERT", "TLS certificate file, serves HTTPS with HTTP/2 when set (reloaded on change)", &BHP_TLS_CERT},
+	{"BHP_TLS_KEY", "TLS private key file of the certificate", &BHP_TLS_KEY},
+	{"BHP_TLS_MIN_VERSION", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3", &BHP_TLS_MIN_VERSION},
+	{"BHP_TLS_CIPHER_SUITES", "TLS 1.0-1.2 cipher suites, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (separated by ';'), empty for Go's defaults", &BHP_TLS_CIPHER_SUITES},
+	{"BHP_H2C", "Accept HTTP/2 without TLS (h2c), e.g. behind a load balancer", &BHP_H2C},
+	{"BHP_HTTP3", "Serve HTTP/3 (QUIC) alongside HTTPS, advertised via Alt-Svc", &BHP_HTTP3},
+	{"BHP_HTTP3_PORT", "UDP port of the HTTP/3 listeners, 0 to use the port of each TCP listener", &BHP_HTTP3_PORT},
+	{"BHP_MAX_CONCURRENCY", "Max concurrent tasks: vips threads per image, and images encoded at once by best format selection", &BHP_MAX_CONCURRENCY},
+	{"BHP_FORCE_FORMAT", "Force selected format, even if the output is bigger", &BHP_FORCE_FORMAT},
+	{"BHP_AUTO_DECREMENT_QUALITY", "Search the highest quality whose output fits the target size", &BHP_AUTO_DECREMENT_QUALITY},
+	{"BHP_USE_BEST_COMPRESSION_FORMAT", "Automatically choose the smallest output of BHP_BEST_FORMAT_CANDIDATES", &BHP_USE_BEST_COMPRESSION_FORMAT},
+	{"BHP_BEST_FORMAT_CANDIDATES", "Formats best format selection chooses from: webp, jpeg, avif, jxl, png-palette (separated by ';')", &BHP_BEST_FORMAT_CANDIDATES},
+	{"BHP_BEST_FORMAT_MIN_SSIM", "Minimum SSIM of the outputs best format selection chooses from, empty to choose by size only", &BHP_BEST_FORMAT_MIN_SSIM},
+	{"BHP_AUTO_QUALITY_MIN", "Lowest quality the quality search may use", &BHP_AUTO_QUALITY_MIN},
+	{"BHP_AUTO_QUALITY_TARGET_PERCENT", "Target size of the quality search, in percent of the original image", &BHP_AUTO_QUALITY_TARGET_PERCENT},
+	{"BHP_AUTO_QUALITY_TARGET_SIZE", "Target size of the quality search in bytes, e.g. 200KB, empty for no limit", &BHP_AUTO_QUALITY_TARGET_SIZE},
+	{"BHP_SSIM_TARGET", "SSIM the output must reach, the lowest quality reaching it is used, e.g. 0.95, empty to disable", &BHP_SSIM_TARGET},
+	{"BHP_SSIM_TIME_BUDGET", "How long the search for the quality reaching the SSIM target may take", &BHP_SSIM_TIME_BUDGET},
+	{"BHP_EXTERNAL_REQUEST_TIMEOUT", "External request timeout", &BHP_EXTERNAL_REQUEST_TIMEOUT},
+	{"BHP_EXTERNAL_REQUEST_RETRIES", "Number of retries for external requests", &BHP_EXTERNAL_REQUEST_RETRIES},
+	{"BHP_EXTERNAL_REQUEST_REDIRECTS", "Maximum redirects for external requests", &BHP_EXTERNAL_REQUEST_REDIRECTS},
+	{"BHP_EXTERNAL_REQUEST_OMIT_HEADERS", "Headers to omit from external requests (separated by ';')", &BHP_EXTERNAL_REQUEST_OMIT_HEADERS},
+	{"BHP_FORWARD_CLIENT_IP", "Send the client IP address to origins in X-Forwarded-For, otherwise forwarding headers are removed", &BHP_FORWARD_CLIENT_IP},
+	{"BHP_RESPONSE_HEADERS_ALLOW", "Regex patterns of the origin response headers passed to clients (separated by ';'), empty for all that are not denied", &BHP_RESPONSE_HEADERS_ALLOW},
+	{"BHP_RESPONSE_HEADERS_DENY", "Regex patterns of the origin response headers not passed to clients (separated by ';')", &BHP_RESPONSE_HEADERS_DENY},
+	{"BHP_CACHE_CONTROL_MIN_TTL", "Minimum max-age of compressed images, used when the origin sends no freshness information", &BHP_CACHE_CONTROL_MIN_TTL},
+	{"BHP_CACHE_CONTROL_MAX_TTL", "Maximum max-age of compressed images", &BHP_CACHE_CONTROL_MAX_TTL},
+	{"BHP_CACHE_SIZE", "Memory used to cache compressed images, e.g. 256MB, empty to disable the cache", &BHP_CACHE_SIZE},
+	{"BHP_CACHE_STALE_WHILE_REVALIDATE", "How long expired cached images are still served while they are revalidated in the background", &BHP_CACHE_STALE_WHILE_REVALIDATE},
+	{"BHP_MAX_IMAGE_SIZE", "Largest decoded image fetched from origins, larger images are redirected, empty for no limit", &BHP_MAX_IMAGE_SIZE},
+	{"BHP_NON_IMAGE_POLICY", "What to do when the URL is not an image: passthrough (stream it unchanged) or redirect", &BHP_NON_IMAGE_POLICY},
+	{"BHP_PASSTHROUGH_MAX_SIZE", "Largest content passed through unchanged, larger content is redirected, empty for no limit", &BHP_PASSTHROUGH_MAX_SIZE},
+	{"BHP_FLARESOLVERR_URL", "URL of the FlareSolverr instance to use for anti-bot challenges", &BHP_FLARESOLVERR_URL},
+	{"BHP_FLARESOLVERR_SESSION_TTL", "How long the cookies solved by FlareSolverr are reused for the same host, 0s to solve every request", &BHP_FLARESOLVERR_SESSION_TTL},
+	{"BHP_IMGPROXY_PATH_PREFIX", "Path prefix of the imgproxy compatible API, empty to disable", &BHP_IMGPROXY_PATH_PREFIX},
+	{"BHP_IMGPROXY_KEY", "Hex-encoded key to verify imgproxy URL signatures", &BHP_IMGPROXY_KEY},
+	{"BHP_IMGPROXY_SALT", "Hex-encoded salt to verify imgproxy URL signatures", &BHP_IMGPROXY_SALT},
+	{"BHP_WESERV_PATH_PREFIX", "Path of the weserv compatible API, empty to disable", &BHP_WESERV_PATH_PREFIX},
+	{"BHP_URL_SIGNING_KEYS", "Keys to verify URL signatures, the first one signs (separated by ';'), empty to disable", &BHP_URL_SIGNING_KEYS},
+	{"BHP_AUTH_HTPASSWD_FILE", "htpasswd file with bcrypt hashed users for HTTP Basic authentication", &BHP_AUTH_HTPASSWD_FILE},
+	{"BHP_AUTH_API_KEYS", "API keys as name:key (separated by ';')", &BHP_AUTH_API_KEYS},
+	{"BHP_AUTH_CREDENTIAL_SETTINGS", "Per-credential settings as name:quality=10-60,grayscale=true (separated by ';')", &BHP_AUTH_CREDENTIAL_SETTINGS},
+	{"BHP_AUTH_MAX_FAILURES", "Failed authentication attempts allowed per IP address within the failure window, 0 to disable", &BHP_AUTH_MAX_FAILURES},
+	{"BHP_AUTH_FAILURE_WINDOW", "Window in which failed authentication attempts are counted and blocked", &BHP_AUTH_FAILURE_WINDOW},
+	{"BHP_TRUSTED_PROXIES", "IP addresses or CIDRs of reverse proxies whose X-Forwarded-For header is trusted (separated by ';')", &BHP_TRUSTED_PROXIES},
+	{"BHP_RATE_LIMIT_PER_MINUTE", "Requests allowed per client and minute, 0 to disable", &BHP_RATE_LIMIT_PER_MINUTE},
+	{"BHP_RATE_LIMIT_BURST", "Requests a client may make at once, 0 for 10 seconds worth of requests", &BHP_RATE_LIMIT_BURST},
+	{"BHP_DAILY_UPSTREAM_QUOTA", "Bytes a client may fetch from origins per UTC day, e.g. 500MB, empty to disable", &BHP_DAILY_UPSTREAM_QUOTA},
+	{"BHP_QUOTA_STATE_FILE", "File the daily quota counters are persisted to, so restarts do not reset them", &BHP_QUOTA_STATE_FILE},
+	{"BHP_STATS_DB", "Database file of the savings statistics, empty to disable them", &BHP_STATS_DB},
+	{"BHP_STATS_RETENTION_DAYS", "Days the savings statistics are kept for, 0 to keep them forever", &BHP_STATS_RETENTION_DAYS},
+	{"BHP_STATS_PATH", "Path of the statistics JSON API, empty to disable", &BHP_STATS_PATH},
+	{"BHP_ADMIN_PATH_PREFIX", "Path prefix of the admin dashboard, empty to disable", &BHP_ADMIN_PATH_PREFIX},
+	{"BHP_ADMIN_USERS", "User names, API key names or IP addresses allowed to use the admin pages (separated by ';')", &BHP_ADMIN_USERS},
+	{"BHP_ADMIN_ADDR", "Address of the admin API listener, like 127.0.0.1:8081 or unix:/run/bhp-admin.sock, empty to disable", &BHP_ADMIN_ADDR},
+	{"BHP_ADMIN_TOKEN", "Bearer token required by the admin API, also accepted by the admin pages", &BHP_ADMIN_TOKEN},
+}
+
+// secretConfigOptions are masked when the configuration is displayed
+var secretConfigOptions = map[string]bool{
+	"BHP_IMGPROXY_KEY":     true,
+	"BHP_IMGPROXY_SALT":    true,
+	"BHP_URL_SIGNING_KEYS": true,
+	"BHP_AUTH_API_KEYS":    true,
+	"BHP_ADMIN_TOKEN":      true,
+}
+
+// FlagName returns the command line flag mirroring the option,
+// e.g. BHP_EXTERNAL_REQUEST_TIMEOUT -> external-request-timeout
+func (option ConfigOption) FlagName() string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(option.Name, "BHP_"), "_", "-"))
+}
+
+// Set parses rawValue into the type of the option and stores it
+func (option ConfigOption) Set(rawValue string) error {
+	switch v := option.Value.(type) {
+	case *int:
+		intValue, err := strconv.Atoi(strings.TrimSpace(rawValue))
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", rawValue)
+		}
+		*v = intValue
+	case *bool:
+		boolValue, err := strconv.ParseBool(strings.TrimSpace(rawValue))
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", rawValue)
+		}
+		*v = boolValue
+	case *[]string:
+		*v = strings.FieldsFunc(os.ExpandEnv(rawValue), func(r rune) bool {
+			return r == '\n' || r == ';'
+		})
+	case *string:
+		*v = rawValue
+	default:
+		return fmt.Errorf("unsupported option type %T", option.Value)
+	}
+	return nil
+}
+
+// String implements flag.Value, so options can be registered as flags directly.
+// Secret values are masked.
+func (option ConfigOption) String() string {
+	if option.Value == nil {
+		return ""
+	}
+	if secretConfigOptions[option.Name] {
+		switch v := option.Value.(type) {
+		case *string:
+			if *v != "" {
+				return "********"
+			}
+		case *[]string:
+			if len(*v) > 0 {
+				return fmt.Sprintf("[%d secret(s)]", len(*v))
+			}
+		}
+	}
+	return FormatConfigValue(option.Value)
+}
+
+// IsBoolFlag allows boolean options to be passed as "--flag" without a value
+func (option ConfigOption) IsBoolFlag() bool {
+	_, ok := option.Value.(*bool)
+	return ok
+}
+
+// FindConfigOption looks up an option by its BHP_* name
+func FindConfigOption(name string) (ConfigOption, bool) {
+	for _, option := range ConfigOptions {
+		if option.Name == name {
+			return option, true
+		}
+	}
+	return ConfigOption{}, false
+}
+
+// LoadConfigFile reads KEY=VALUE lines from an env-style config file.
+// Options already set in the environment or listed in skip are left untouched,
+// so the precedence is: flags > environment > config file > defaults.
+func LoadConfigFile(path string, skip map[string]bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	for lineNumber, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			configErrors = append(configErrors, fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNumber+1))
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		option, ok := FindConfigOption(key)
+		if !ok {
+			configErrors = append(configErrors, fmt.Errorf("%s:%d: unknown option %s", path, lineNumber+1, key))
+			continue
+		}
+		if _, exists := os.LookupEnv(key); exists || skip[key] {
+			continue
+		}
+		if err := option.Set(value); err != nil {
+			configErrors = append(configErrors, fmt.Errorf("%s: %v (from %s)", key, err, path))
+		}
+	}
+
+	return nil
+}
+
+// RefreshConfig recomputes state derived from the BHP_* variables,
+// it must be called after they were changed by flags or a config file
+func RefreshConfig() {
+	omittedHeadersRegexes, omittedHeadersErrors = compileHeaderPatterns("BHP_EXTERNAL_REQUEST_OMIT_HEADERS", BHP_EXTERNAL_REQUEST_OMIT_HEADERS)
+	allowedResponseHeaders, allowedResponseHeadersErrors = compileHeaderPatterns("BHP_RESPONSE_HEADERS_ALLOW", BHP_RESPONSE_HEADERS_ALLOW)
+	deniedResponseHeaders, deniedResponseHeadersErrors = compileHeaderPatterns("BHP_RESPONSE_HEADERS_DENY", BHP_RESPONSE_HEADERS_DENY)
+	imgproxyKey, imgproxyKeyErrors = decodeImgproxySecret("BHP_IMGPROXY_KEY", BHP_IMGPROXY_KEY)
+	imgproxySalt, imgproxySaltErrors = decodeImgproxySecret("BHP_IMGPROXY_SALT", BHP_IMGPROXY_SALT)
+	urlSigningKeys = toSigningKeys(BHP_URL_SIGNING_KEYS)
+	authConfiguration, authErrors = loadAuthConfig()
+	trustedProxies, trustedProxiesErrors = parseTrustedProxies(BHP_TRUSTED_PROXIES)
+	dailyQuota, dailyQuotaErrors = parseDailyQuota(BHP_DAILY_UPSTREAM_QUOTA)
+	cacheSize, cacheSizeErrors = parseSizeOption("BHP_CACHE_SIZE", BHP_CACHE_SIZE)
+	passthroughMaxSize, passthroughMaxSizeErrors = parseSizeOption("BHP_PASSTHROUGH_MAX_SIZE", BHP_PASSTHROUGH_MAX_SIZE)
+	maxImageSize, maxImageSizeErrors = parseSizeOption("BHP_MAX_IMAGE_SIZE", BHP_MAX_IMAGE_SIZE)
+	autoQualityTargetSize, autoQualityTargetSizeErrors = parseSizeOption("BHP_AUTO_QUALITY_TARGET_SIZE", BHP_AUTO_QUALITY_TARGET_SIZE)
+	ssimTarget, ssimTargetErrors = parseSsimTarget(BHP_SSIM_TARGET)
+	bestFormatMinSsim, bestFormatMinSsimErrors = parseBestFormatMinSsim(BHP_BEST_FORMAT_MIN_SSIM)
+	candidateSlots = make(chan struct{}, max(BHP_MAX_CONCURRENCY, 1))
+}
+
+// FormatConfigValue renders the value behind a ConfigOption for display
+func FormatConfigValue(value any) string {
+	switch v := value.(type) {
+	case *int:
+		return fmt.Sprint(*v)
+	case *bool:
+		return fmt.Sprint(*v)
+	case *[]string:
+		return fmt.Sprint(*v)
+	case *string:
+		if *v == "" {
+			return "not set"
+		}
+		return *v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ValidateConfig checks the effective configuration and returns every problem
+// found, instead of stopping at the first one
+func ValidateConfig() []error {
+	errs := make([]error, 0, len(configErrors))
+	errs = append(errs, configErrors...)
+
+	if BHP_PORT < 1 || BHP_PORT > 65535 {
+		errs = append(errs, fmt.Errorf("BHP_PORT: %d is not a valid port (1-65535)", BHP_PORT))
+	}
+
+	errs = append(errs, listenErrors()...)
+	errs = append(errs, tlsErrors()...)
+	errs = append(errs, http3Errors()...)
+
+	if BHP_MAX_CONCURRENCY < 1 {
+		errs = append(errs, fmt.Errorf("BHP_MAX_CONCURRENCY: must be at least 1, got %d", BHP_MAX_CONCURRENCY))
+	}
+
+	if duration, err := time.ParseDuration(BHP_EXTERNAL_REQUEST_TIMEOUT); err != nil {
+		errs = append(errs, fmt.Errorf("BHP_EXTERNAL_REQUEST_TIMEOUT: invalid duration %q", BHP_EXTERNAL_REQUEST_TIMEOUT))
+	} else if duration <= 0 {
+		errs = append(errs, fmt.Errorf("BHP_EXTERNAL_REQUEST_TIMEOUT: must be positive, got %s", duration))
+	}
+
+	if BHP_EXTERNAL_REQUEST_RETRIES < 0 {
+		errs = append(errs, fmt.Errorf("BHP_EXTERNAL_REQUEST_RETRIES: must not be negative, got %d", BHP_EXTERNAL_REQUEST_RETRIES))
+	}
+
+	if BHP_EXTERNAL_REQUEST_REDIRECTS < 0 {
+		errs = append(errs, fmt.Errorf("BHP_EXTERNAL_REQUEST_REDIRECTS: must not be negative, got %d", BHP_EXTERNAL_REQUEST_REDIRECTS))
+	}
+
+	errs = append(errs, omittedHeadersErrors...)
+	errs = append(errs, allowedResponseHeadersErrors...)
+	errs = append(errs, deniedResponseHeadersErrors...)
+	errs = append(errs, cacheControlErrors()...)
+	errs = append(errs, cacheErrors()...)
+	errs = append(errs, nonImagePolicyErrors()...)
+	errs = append(errs, maxImageSizeErrors...)
+
+	errs = append(errs, modesErrors(CurrentModes())...)
+	errs = append(errs, autoQualityErrors()...)
+	errs = append(errs, ssimErrors()...)
+	errs = append(errs, bestFormatErrors()...)
+
+	if strings.TrimSpace(BHP_FLARESOLVERR_URL) != "" {
+		if err := validateHttpUrl(BHP_FLARESOLVERR_URL); err != nil {
+			errs = append(errs, fmt.Errorf("BHP_FLARESOLVERR_URL: %v", err))
+		}
+	}
+	if duration, err := time.ParseDuration(BHP_FLARESOLVERR_SESSION_TTL); err != nil || duration < 0 {
+		errs = append(errs, fmt.Errorf("BHP_FLARESOLVERR_SESSION_TTL: invalid duration %q", BHP_FLARESOLVERR_SESSION_TTL))
+	}
+
+	if BHP_IMGPROXY_PATH_PREFIX != "" && !strings.HasPrefix(BHP_IMGPROXY_PATH_PREFIX, "/") {
+		errs = append(errs, fmt.Errorf("BHP_IMGPROXY_PATH_PREFIX: must start with '/', got %q", BHP_IMGPROXY_PATH_PREFIX))
+	}
+
+	if BHP_WESERV_PATH_PREFIX != "" && !strings.HasPrefix(BHP_WESERV_PATH_PREFIX, "/") {
+		errs = append(errs, fmt.Errorf("BHP_WESERV_PATH_PREFIX: must start with '/', got %q", BHP_WESERV_PATH_PREFIX))
+	}
+	if BHP_WESERV_PATH_PREFIX != "" && strings.TrimRight(BHP_WESERV_PATH_PREFIX, "/") == strings.TrimRight(BHP_IMGPROXY_PATH_PREFIX, "/") {
+		errs = append(errs, fmt.Errorf("BHP_WESERV_PATH_PREFIX and BHP_IMGPROXY_PATH_PREFIX must be different"))
+	}
+
+	errs = append(errs, imgproxyKeyErrors...)
+	errs = append(errs, imgproxySaltErrors...)
+	if (BHP_IMGPROXY_KEY == "") != (BHP_IMGPROXY_SALT == "") {
+		errs = append(errs, fmt.Errorf("BHP_IMGPROXY_KEY and BHP_IMGPROXY_SALT must be set together"))
+	}
+
+	for i, key := range BHP_URL_SIGNING_KEYS {
+		if len(key) < minSigningKeyLength {
+			errs = append(errs, fmt.Errorf("BHP_URL_SIGNING_KEYS: key #%d is shorter than %d characters", i+1, minSigningKeyLength))
+		}
+	}
+
+	errs = append(errs, authErrors...)
+	if BHP_AUTH_MAX_FAILURES < 0 {
+		errs = append(errs, fmt.Errorf("BHP_AUTH_MAX_FAILURES: must not be negative, got %d", BHP_AUTH_MAX_FAILURES))
+	}
+	if duration, err := time.ParseDuration(BHP_AUTH_FAILURE_WINDOW); err != nil || duration <= 0 {
+		errs = append(errs, fmt.Errorf("BHP_AUTH_FAILURE_WINDOW: invalid duration %q", BHP_AUTH_FAILURE_WINDOW))
+	}
+
+	errs = append(errs, trustedProxiesErrors...)
+	if BHP_RATE_LIMIT_PER_MINUTE < 0 {
+		errs = append(errs, fmt.Errorf("BHP_RATE_LIMIT_PER_MINUTE: must not be negative, got %d", BHP_RATE_LIMIT_PER_MINUTE))
+	}
+	if BHP_RATE_LIMIT_BURST < 0 {
+		errs = append(errs, fmt.Errorf("BHP_RATE_LIMIT_BURST: must not be negative, got %d", BHP_RATE_LIMIT_BURST))
+	}
+	errs = append(errs, dailyQuotaErrors...)
+	if BHP_QUOTA_STATE_FILE != "" && dailyQuota <= 0 {
+		errs = append(errs, fmt.Errorf("BHP_QUOTA_STATE_FILE: requires BHP_DAILY_UPSTREAM_QUOTA to be set"))
+	}
+
+	if BHP_STATS_RETENTION_DAYS < 0 {
+		errs = append(errs, fmt.Errorf("BHP_STATS_RETENTION_DAYS: must not be negative, got %d", BHP_STATS_RETENTION_DAYS))
+	}
+	if BHP_STATS_PATH != "" && !strings.HasPrefix(BHP_STATS_PATH, "/") {
+		errs = append(errs, fmt.Errorf("BHP_STATS_PATH: must start with '/', got %q", BHP_STATS_PATH))
+	}
+	if BHP_ADMIN_PATH_PREFIX != "" && !strings.HasPrefix(BHP_ADMIN_PATH_PREFIX, "/") {
+		errs = append(errs, fmt.Errorf("BHP_ADMIN_PATH_PREFIX: must start with '/', got %q", BHP_ADMIN_PATH_PREFIX))
+	}
+	if (BHP_ADMIN_ADDR != "" || BHP_ADMIN_TOKEN != "") && len(BHP_ADMIN_TOKEN) < minAdminTokenLength {
+		errs = append(errs, fmt.Errorf("BHP_ADMIN_TOKEN: must be at least %d characters, and is required when BHP_ADMIN_ADDR is set", minAdminTokenLength))
+	}
+
+	return errs
+}
+
+func validateHttpUrl(rawUrl string) error {
+	parsedUrl, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %v", rawUrl, err)
+	}
+	if parsedUrl.Scheme != "http" && parsedUrl.Scheme != "https" {
+		return fmt.Errorf("invalid url %q: scheme must be http or https", rawUrl)
+	}
+	if parsedUrl.Host == "" {
+		return fmt.Errorf("invalid url %q: missing host", rawUrl)
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"compress/zlib"
 	"fmt"
 	"io"
 	"strings"
@@ -14,261 +16,99 @@ import (
 	"github.com/ulikunitz/xz"
 )
 
-// DecompressResponse automatically detects and decompresses HTTP response data
-// based on Content-Encoding header and magic bytes
-func DecompressResponse(data []byte, contentEncoding string) ([]byte, error) {
-	if len(data) == 0 {
-		return data, nil
+// compressionSignatures are the magic bytes of the compressed bodies readImageBody recognizes, by encoding
+var compressionSignatures = []struct {
+	Magic    []byte
+	Encoding string
+}{
+	{[]byte{0x1f, 0x8b}, "gzip"},
+	{[]byte{0x78, 0x01}, "deflate"},
+	{[]byte{0x78, 0x5e}, "deflate"},
+	{[]byte{0x78, 0x9c}, "deflate"},
+	{[]byte{0x78, 0xda}, "deflate"},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, "zstd"},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, "lz4"},
+	{[]byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}, "xz"},
+}
+
+// encodingByMagicBytes returns the encoding of compressed data from its first bytes, "" when it is not compressed
+func encodingByMagicBytes(data []byte) string {
+	for _, signature := range compressionSignatures {
+		if bytes.HasPrefix(data, signature.Magic) {
+			return signature.Encoding
+		}
 	}
+	return ""
+}
 
-	// Normalize content encoding
-	encoding := strings.ToLower(strings.TrimSpace(contentEncoding))
+// decompressReader decodes a body on the fly, closing it releases the decoders but not the body
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
 
-	// If no encoding specified, try to detect by magic bytes
-	if encoding == "" || encoding == "identity" {
-		return DecompressByMagicBytes(data)
+func (reader *decompressReader) Close() error {
+	for _, closer := range reader.closers {
+		closer.Close()
 	}
+	return nil
+}
 
-	// Handle multiple encodings (e.g., "gzip, deflate")
-	// Encodings are applied in reverse order (last applied first to decompress)
-	encodings := strings.Split(encoding, ",")
-	result := data
+// NewDecompressReader decodes the body on the fly based on the Content-Encoding header.
+// Unknown encodings are read as they are.
+func NewDecompressReader(body io.Reader, contentEncoding string) (io.ReadCloser, error) {
+	reader := &decompressReader{Reader: body}
 
+	// Encodings are applied in reverse order (last applied first to decompress)
+	encodings := strings.Split(strings.ToLower(contentEncoding), ",")
 	for i := len(encodings) - 1; i >= 0; i-- {
-		enc := strings.TrimSpace(encodings[i])
-		if enc == "" || enc == "identity" {
-			continue // Skip empty or identity encodings
-		}
-
-		var err error
-		result, err = decompressSingle(result, enc)
+		decoder, closer, err := decompressReaderSingle(reader.Reader, strings.TrimSpace(encodings[i]))
 		if err != nil {
-			// If decompression fails, try magic bytes detection as fallback
-			fallback, fallbackErr := DecompressByMagicBytes(result)
-			if fallbackErr != nil {
-				return nil, fmt.Errorf("failed to decompress with %s: %v (fallback also failed: %v)", enc, err, fallbackErr)
-			}
-			result = fallback
+			reader.Close()
+			return nil, fmt.Errorf("failed to decompress with %s: %v", strings.TrimSpace(encodings[i]), err)
+		}
+		reader.Reader = decoder
+		if closer != nil {
+			reader.closers = append(reader.closers, closer)
 		}
 	}
 
-	return result, nil
+	return reader, nil
 }
 
-// decompressSingle handles decompression for a single encoding type
-func decompressSingle(data []byte, encoding string) ([]byte, error) {
+// decompressReaderSingle wraps the reader with the decoder of a single encoding
+func decompressReaderSingle(reader io.Reader, encoding string) (io.Reader, io.Closer, error) {
 	switch encoding {
-	case "gzip":
-		return DecompressGzip(data)
+	case "gzip", "x-gzip":
+		buffered := bufio.NewReader(reader)
+		if magic, _ := buffered.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			return buffered, nil, nil // Not gzip data
+		}
+		decoder, err := gzip.NewReader(buffered)
+		return decoder, decoder, err
 	case "deflate":
-		return DecompressDeflate(data)
+		// HTTP deflate is zlib, but some servers send raw deflate
+		buffered := bufio.NewReader(reader)
+		if header, _ := buffered.Peek(2); len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			decoder, err := zlib.NewReader(buffered)
+			return decoder, decoder, err
+		}
+		decoder := flate.NewReader(buffered)
+		return decoder, decoder, nil
 	case "br", "brotli":
-		return DecompressBrotli(data)
+		return brotli.NewReader(reader), nil, nil
 	case "zstd":
-		return DecompressZstd(data)
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decoder, decoder.IOReadCloser(), nil
 	case "lz4":
-		return DecompressLZ4(data)
+		return lz4.NewReader(reader), nil, nil
 	case "xz":
-		return DecompressXZ(data)
-	case "identity", "":
-		return data, nil // No compression
+		decoder, err := xz.NewReader(reader)
+		return decoder, nil, err
 	default:
-		// Try to detect by magic bytes if encoding is unknown
-		return DecompressByMagicBytes(data)
-	}
-}
-
-// DecompressGzip decompresses gzip-encoded data
-func DecompressGzip(data []byte) ([]byte, error) {
-	if len(data) < 2 {
-		return data, nil
-	}
-
-	// Check gzip magic bytes
-	if data[0] != 0x1f || data[1] != 0x8b {
-		return data, nil // Not gzip data
-	}
-
-	reader, err := gzip.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
-	}
-	defer reader.Close()
-
-	result, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read gzip data: %v", err)
-	}
-
-	return result, nil
-}
-
-// DecompressDeflate decompresses deflate-encoded data
-func DecompressDeflate(data []byte) ([]byte, error) {
-	if len(data) == 0 {
-		return data, nil
-	}
-
-	// Try raw deflate first
-	reader := flate.NewReader(bytes.NewReader(data))
-	defer reader.Close()
-
-	result, err := io.ReadAll(reader)
-	if err == nil {
-		return result, nil
-	}
-
-	// Try zlib format (deflate with header)
-	if len(data) >= 2 {
-		zlibReader := flate.NewReader(bytes.NewReader(data))
-		defer zlibReader.Close()
-
-		zlibResult, zlibErr := io.ReadAll(zlibReader)
-		if zlibErr == nil {
-			return zlibResult, nil
-		}
-	}
-
-	return nil, fmt.Errorf("failed to decompress deflate data: %v", err)
-}
-
-// DecompressBrotli decompresses brotli-encoded data
-func DecompressBrotli(data []byte) ([]byte, error) {
-	if len(data) == 0 {
-		return data, nil
-	}
-
-	reader := brotli.NewReader(bytes.NewReader(data))
-	result, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress brotli data: %v", err)
-	}
-
-	return result, nil
-}
-
-// DecompressZstd decompresses zstandard-encoded data
-func DecompressZstd(data []byte) ([]byte, error) {
-	decoder, err := zstd.NewReader(nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create zstd decoder: %v", err)
-	}
-	defer decoder.Close()
-
-	result, err := decoder.DecodeAll(data, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress zstd data: %v", err)
-	}
-
-	return result, nil
-}
-
-// DecompressLZ4 decompresses LZ4-encoded data
-func DecompressLZ4(data []byte) ([]byte, error) {
-	var out bytes.Buffer
-	reader := lz4.NewReader(bytes.NewReader(data))
-
-	_, err := io.Copy(&out, reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress LZ4 data: %v", err)
-	}
-
-	return out.Bytes(), nil
-}
-
-// DecompressXZ decompresses XZ-encoded data
-func DecompressXZ(data []byte) ([]byte, error) {
-	reader, err := xz.NewReader(bytes.NewReader(data))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create xz reader: %v", err)
-	}
-
-	result, err := io.ReadAll(reader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decompress xz data: %v", err)
-	}
-
-	return result, nil
-}
-
-// DecompressByMagicBytes attempts to detect compression format by magic bytes
-func DecompressByMagicBytes(data []byte) ([]byte, error) {
-	if len(data) < 2 {
-		return data, nil
-	}
-
-	// Try each format and return the first successful decompression
-	// Gzip magic bytes: 0x1f 0x8b
-	if data[0] == 0x1f && data[1] == 0x8b {
-		if result, err := DecompressGzip(data); err == nil {
-			return result, nil
-		}
-	}
-
-	// Zlib magic bytes: 0x78 followed by various values
-	if data[0] == 0x78 && (data[1] == 0x01 || data[1] == 0x5e || data[1] == 0x9c || data[1] == 0xda) {
-		if result, err := DecompressDeflate(data); err == nil {
-			return result, nil
-		}
+		return reader, nil, nil
 	}
-
-	if len(data) >= 4 {
-		// Zstandard magic bytes: 0x28 0xb5 0x2f 0xfd
-		if data[0] == 0x28 && data[1] == 0xb5 && data[2] == 0x2f && data[3] == 0xfd {
-			if result, err := DecompressZstd(data); err == nil {
-				return result, nil
-			}
-		}
-
-		// LZ4 magic bytes: 0x04 0x22 0x4d 0x18
-		if data[0] == 0x04 && data[1] == 0x22 && data[2] == 0x4d && data[3] == 0x18 {
-			if result, err := DecompressLZ4(data); err == nil {
-				return result, nil
-			}
-		}
-	}
-
-	if len(data) >= 6 {
-		// XZ magic bytes: 0xfd 0x37 0x7a 0x58 0x5a 0x00
-		if data[0] == 0xfd && data[1] == 0x37 && data[2] == 0x7a &&
-			data[3] == 0x58 && data[4] == 0x5a && data[5] == 0x00 {
-			if result, err := DecompressXZ(data); err == nil {
-				return result, nil
-			}
-		}
-	}
-
-	// If no magic bytes match or decompression fails, return original data
-	return data, nil
-}
-
-var supportedEncodingsMap = map[string]bool{
-	"gzip":     true,
-	"deflate":  true,
-	"br":       true,
-	"brotli":   true,
-	"zstd":     true,
-	"lz4":      true,
-	"xz":       true,
-	"identity": true,
-	"":         true,
-}
-
-// GetSupportedEncodings returns a list of all supported compression encodings
-func GetSupportedEncodings() []string {
-	return []string{
-		"gzip",
-		"deflate",
-		"br", "brotli",
-		"zstd",
-		"lz4",
-		"xz",
-		"identity",
-	}
-}
-
-// IsEncodingSupported checks if a given encoding is supported
-func IsEncodingSupported(encoding string) bool {
-	encoding = strings.ToLower(strings.TrimSpace(encoding))
-	return supportedEncodingsMap[encoding]
 }
@@ -1,25 +1,35 @@
 package utils
 
 import (
+	"fmt"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
 )
 
+// configErrors collects every value (from the environment or a config file)
+// that could not be parsed into the type of its default, so ValidateConfig
+// can report them.
+var configErrors []error
+
 func GetEnv[T any](key string, defaultValue T) T {
 	switch any(defaultValue).(type) {
 	case int:
 		if value, exists := os.LookupEnv(key); exists {
-			if intValue, err := strconv.Atoi(value); err == nil {
+			intValue, err := strconv.Atoi(strings.TrimSpace(value))
+			if err == nil {
 				return any(intValue).(T)
 			}
+			configErrors = append(configErrors, fmt.Errorf("%s: invalid integer %q", key, value))
 		}
 	case bool:
 		if value, exists := os.LookupEnv(key); exists {
-			if boolValue, err := strconv.ParseBool(value); err == nil {
+			boolValue, err := strconv.ParseBool(strings.TrimSpace(value))
+			if err == nil {
 				return any(boolValue).(T)
 			}
+			configErrors = append(configErrors, fmt.Errorf("%s: invalid boolean %q", key, value))
 		}
 	case []string:
 		if value, exists := os.LookupEnv(key); exists {
@@ -41,13 +51,62 @@ func GetEnv[T any](key string, defaultValue T) T {
 
 var (
 	BHP_PORT                          = GetEnv("BHP_PORT", 80)
+	BHP_LISTEN                        = GetEnv("BHP_LISTEN", []string{})
+	BHP_UNIX_SOCKET_MODE              = GetEnv("BHP_UNIX_SOCKET_MODE", "0660")
+	BHP_TLS_CERT                      = GetEnv("BHP_TLS_CERT", "")
+	BHP_TLS_KEY                       = GetEnv("BHP_TLS_KEY", "")
+	BHP_TLS_MIN_VERSION               = GetEnv("BHP_TLS_MIN_VERSION", "1.2")
+	BHP_TLS_CIPHER_SUITES             = GetEnv("BHP_TLS_CIPHER_SUITES", []string{})
+	BHP_H2C                           = GetEnv("BHP_H2C", false)
+	BHP_HTTP3                         = GetEnv("BHP_HTTP3", false)
+	BHP_HTTP3_PORT                    = GetEnv("BHP_HTTP3_PORT", 0)
 	BHP_MAX_CONCURRENCY               = GetEnv("BHP_MAX_CONCURRENCY", runtime.NumCPU())
 	BHP_FORCE_FORMAT                  = GetEnv("BHP_FORCE_FORMAT", false)
 	BHP_AUTO_DECREMENT_QUALITY        = GetEnv("BHP_AUTO_DECREMENT_QUALITY", false)
 	BHP_USE_BEST_COMPRESSION_FORMAT   = GetEnv("BHP_USE_BEST_COMPRESSION_FORMAT", false)
+	BHP_BEST_FORMAT_CANDIDATES        = GetEnv("BHP_BEST_FORMAT_CANDIDATES", []string{"webp", "jpeg"})
+	BHP_BEST_FORMAT_MIN_SSIM          = GetEnv("BHP_BEST_FORMAT_MIN_SSIM", "")
+	BHP_AUTO_QUALITY_MIN              = GetEnv("BHP_AUTO_QUALITY_MIN", 10)
+	BHP_AUTO_QUALITY_TARGET_PERCENT   = GetEnv("BHP_AUTO_QUALITY_TARGET_PERCENT", 100)
+	BHP_AUTO_QUALITY_TARGET_SIZE      = GetEnv("BHP_AUTO_QUALITY_TARGET_SIZE", "")
+	BHP_SSIM_TARGET                   = GetEnv("BHP_SSIM_TARGET", "")
+	BHP_SSIM_TIME_BUDGET              = GetEnv("BHP_SSIM_TIME_BUDGET", "2s")
 	BHP_EXTERNAL_REQUEST_TIMEOUT      = GetEnv("BHP_EXTERNAL_REQUEST_TIMEOUT", "60s")
 	BHP_EXTERNAL_REQUEST_RETRIES      = GetEnv("BHP_EXTERNAL_REQUEST_RETRIES", 5)
 	BHP_EXTERNAL_REQUEST_REDIRECTS    = GetEnv("BHP_EXTERNAL_REQUEST_REDIRECTS", 10)
 	BHP_EXTERNAL_REQUEST_OMIT_HEADERS = GetEnv("BHP_EXTERNAL_REQUEST_OMIT_HEADERS", []string{})
+	BHP_FORWARD_CLIENT_IP             = GetEnv("BHP_FORWARD_CLIENT_IP", false)
+	BHP_RESPONSE_HEADERS_ALLOW        = GetEnv("BHP_RESPONSE_HEADERS_ALLOW", []string{})
+	BHP_RESPONSE_HEADERS_DENY         = GetEnv("BHP_RESPONSE_HEADERS_DENY", []string{"^set-cookie2?$"})
+	BHP_CACHE_CONTROL_MIN_TTL         = GetEnv("BHP_CACHE_CONTROL_MIN_TTL", "1h")
+	BHP_CACHE_CONTROL_MAX_TTL         = GetEnv("BHP_CACHE_CONTROL_MAX_TTL", "720h")
+	BHP_CACHE_SIZE                    = GetEnv("BHP_CACHE_SIZE", "")
+	BHP_CACHE_STALE_WHILE_REVALIDATE  = GetEnv("BHP_CACHE_STALE_WHILE_REVALIDATE", "1m")
+	BHP_MAX_IMAGE_SIZE                = GetEnv("BHP_MAX_IMAGE_SIZE", "100MB")
+	BHP_NON_IMAGE_POLICY              = GetEnv("BHP_NON_IMAGE_POLICY", "redirect")
+	BHP_PASSTHROUGH_MAX_SIZE          = GetEnv("BHP_PASSTHROUGH_MAX_SIZE", "10MB")
 	BHP_FLARESOLVERR_URL              = GetEnv("BHP_FLARESOLVERR_URL", "")
+	BHP_FLARESOLVERR_SESSION_TTL      = GetEnv("BHP_FLARESOLVERR_SESSION_TTL", "0s")
+	BHP_IMGPROXY_PATH_PREFIX          = GetEnv("BHP_IMGPROXY_PATH_PREFIX", "")
+	BHP_IMGPROXY_KEY                  = GetEnv("BHP_IMGPROXY_KEY", "")
+	BHP_IMGPROXY_SALT                 = GetEnv("BHP_IMGPROXY_SALT", "")
+	BHP_WESERV_PATH_PREFIX            = GetEnv("BHP_WESERV_PATH_PREFIX", "")
+	BHP_URL_SIGNING_KEYS              = GetEnv("BHP_URL_SIGNING_KEYS", []string{})
+	BHP_AUTH_HTPASSWD_FILE            = GetEnv("BHP_AUTH_HTPASSWD_FILE", "")
+	BHP_AUTH_API_KEYS                 = GetEnv("BHP_AUTH_API_KEYS", []string{})
+	BHP_AUTH_CREDENTIAL_SETTINGS      = GetEnv("BHP_AUTH_CREDENTIAL_SETTINGS", []string{})
+	BHP_AUTH_MAX_FAILURES             = GetEnv("BHP_AUTH_MAX_FAILURES", 10)
+	BHP_AUTH_FAILURE_WINDOW           = GetEnv("BHP_AUTH_FAILURE_WINDOW", "15m")
+	BHP_TRUSTED_PROXIES               = GetEnv("BHP_TRUSTED_PROXIES", []string{})
+	BHP_RATE_LIMIT_PER_MINUTE         = GetEnv("BHP_RATE_LIMIT_PER_MINUTE", 0)
+	BHP_RATE_LIMIT_BURST              = GetEnv("BHP_RATE_LIMIT_BURST", 0)
+	BHP_DAILY_UPSTREAM_QUOTA          = GetEnv("BHP_DAILY_UPSTREAM_QUOTA", "")
+	BHP_QUOTA_STATE_FILE              = GetEnv("BHP_QUOTA_STATE_FILE", "")
+	BHP_STATS_DB                      = GetEnv("BHP_STATS_DB", "")
+	BHP_STATS_RETENTION_DAYS          = GetEnv("BHP_STATS_RETENTION_DAYS", 400)
+	BHP_STATS_PATH                    = GetEnv("BHP_STATS_PATH", "/stats")
+	BHP_ADMIN_PATH_PREFIX             = GetEnv("BHP_ADMIN_PATH_PREFIX", "/admin")
+	BHP_ADMIN_USERS                   = GetEnv("BHP_ADMIN_USERS", []string{})
+	BHP_ADMIN_ADDR                    = GetEnv("BHP_ADMIN_ADDR", "")
+	BHP_ADMIN_TOKEN                   = GetEnv("BHP_ADMIN_TOKEN", "")
 )
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -85,3 +86,76 @@ func SolveWithFlareSolverr(targetURL string, timeout time.Duration) (*flareSolve
 
 	return &fsResp.Solution, nil
 }
+
+type flareSolverrSession struct {
+	Solution *flareSolverrSolution
+	SolvedAt time.Time
+}
+
+var (
+	flareSolverrSessions   = map[string]*flareSolverrSession{} // Host -> last solution
+	flareSolverrSessionsMu sync.Mutex
+)
+
+func flareSolverrSessionTtl() time.Duration {
+	ttl, err := time.ParseDuration(BHP_FLARESOLVERR_SESSION_TTL)
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+// flareSolverrSolutionFor reuses the cookies solved for the host of targetURL
+// within BHP_FLARESOLVERR_SESSION_TTL, and solves the challenge otherwise.
+// The second return value tells whether the solution came from the cache.
+func flareSolverrSolutionFor(targetURL string, timeout time.Duration) (*flareSolverrSolution, bool, error) {
+	host := imageDomain(targetURL)
+	ttl := flareSolverrSessionTtl()
+
+	if ttl > 0 {
+		flareSolverrSessionsMu.Lock()
+		session, exists := flareSolverrSessions[host]
+		flareSolverrSessionsMu.Unlock()
+		if exists && time.Since(session.SolvedAt) < ttl {
+			return session.Solution, true, nil
+		}
+	}
+
+	solution, err := SolveWithFlareSolverr(targetURL, timeout)
+	RecordFlareSolverr(err)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if ttl > 0 {
+		flareSolverrSessionsMu.Lock()
+		defer flareSolverrSessionsMu.Unlock()
+		for key, session := range flareSolverrSessions {
+			if time.Since(session.SolvedAt) >= ttl {
+				delete(flareSolverrSessions, key)
+			}
+		}
+		flareSolverrSessions[host] = &flareSolverrSession{Solution: solution, SolvedAt: time.Now()}
+	}
+	return solution, false, nil
+}
+
+// ClearFlareSolverrSessions forgets the solved cookies of the host, or of
+// every host when it is empty, returning how many were forgotten
+func ClearFlareSolverrSessions(host string) int {
+	flareSolverrSessionsMu.Lock()
+	defer flareSolverrSessionsMu.Unlock()
+
+	if host != "" {
+		host = strings.ToLower(host)
+		if _, exists := flareSolverrSessions[host]; !exists {
+			return 0
+		}
+		delete(flareSolverrSessions, host)
+		return 1
+	}
+
+	cleared := len(flareSolverrSessions)
+	flareSolverrSessions = map[string]*flareSolverrSession{}
+	return cleared
+}
@@ -1,5 +1,7 @@
 package utils
 
+import "strings"
+
 var AnimatedImageFormats = []string{
 	"image/gif",
 	"image/apng",
@@ -11,6 +13,7 @@ var AnimatedImageFormats = []string{
 }
 
 var FormatsSupportingVipsUnlimited = []string{
+	"image/avif",
 	"image/heif",
 	"image/jpeg",
 	"image/png",
@@ -30,6 +33,7 @@ var (
 		"application/pdf": true,
 	}
 	unlimitedFormatsMap = map[string]bool{
+		"image/avif":    true,
 		"image/heif":    true,
 		"image/jpeg":    true,
 		"image/png":     true,
@@ -45,3 +49,26 @@ func IsAnimatedFormat(format string) bool {
 func SupportsUnlimited(format string) bool {
 	return unlimitedFormatsMap[format]
 }
+
+// OutputFormats maps the formats the compressor can encode to their Content-Type
+var OutputFormats = map[string]string{
+	"webp": "image/webp",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"avif": "image/avif",
+	"jxl":  "image/jxl",
+	"gif":  "image/gif",
+}
+
+// OutputFormatForInput keeps the input format when it can be encoded,
+// and falls back to webp otherwise
+func OutputFormatForInput(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for format, formatContentType := range OutputFormats {
+		if formatContentType == mediaType {
+			return format
+		}
+	}
+	return "webp"
+}
@@ -1,11 +1,16 @@
 package utils
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func FaviconHandler(w http.ResponseWriter, r *http.Request) {
@@ -18,9 +23,29 @@ func FaviconHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func ProxyHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
+// ErrorResponder decides what the client gets when an image cannot be served
+type ErrorResponder struct {
+	Action  string // Logged as the action taken
+	Respond func(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, err error)
+}
+
+// RedirectResponder sends the client to the original image, which is how
+// the Bandwidth Hero extension expects failures to be handled
+var RedirectResponder = ErrorResponder{
+	Action: "Redirecting to original URL",
+	Respond: func(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, err error) {
+		w.Header().Set("Location", bhpParams.Url)
+		w.WriteHeader(http.StatusFound)
+	},
+}
+
+// fail responds with the error and counts the failure for the dashboard
+func (responder ErrorResponder) fail(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, reason string, err error) {
+	responder.Respond(w, r, bhpParams, status, err)
+	RecordFailure(reason, responder.Action)
+}
 
+func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	bhpParams, err := ParseParams(r)
 	if err != nil {
 		fmt.Fprint(w, "bandwidth-hero-proxy")
@@ -28,95 +53,151 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imageResponse, err := RequestImage(bhpParams.Url, r.Header)
-	if err != nil {
-		w.Header().Set("Location", bhpParams.Url)
-		w.WriteHeader(http.StatusFound)
-
-		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d\n > Grayscale: %t\n> Info:\n > Error: %s\n > Action: Redirecting to original URL\n",
-			bhpParams.Url, bhpParams.Format, bhpParams.Quality, bhpParams.Grayscale, err.Error())
+	if rejectUnsigned(w, r) {
 		return
 	}
-	imageFormat := imageResponse.ResponseHeaders.Get("Content-Type")
-	isAnimated := IsAnimatedFormat(imageFormat)
-	originalImageSize := len(imageResponse.Bytes)
 
-	currentQuality := bhpParams.Quality
-	var compressedImage *CompressImageResult
-	if BHP_USE_BEST_COMPRESSION_FORMAT && !isAnimated {
-		compressedImage, err = CompressImageToBestFormat(imageResponse.Bytes, CompressImageToBestFormatOptions{
-			InputFormat: imageFormat,
-			Grayscale:   bhpParams.Grayscale,
-			Quality:     bhpParams.Quality,
-		})
-	} else if BHP_AUTO_DECREMENT_QUALITY && !isAnimated {
-		compressedImage, currentQuality, err = CompressImageWithAutoQualityDecrement(imageResponse.Bytes, CompressImageWithAutoQualityDecrementOptions{
-			InputFormat:       imageFormat,
-			Format:            bhpParams.Format,
-			Grayscale:         bhpParams.Grayscale,
-			InitialQuality:    bhpParams.Quality,
-			OriginalImageSize: originalImageSize,
-		})
-	} else {
-		compressedImage, err = CompressImage(imageResponse.Bytes, CompressImageOptions{
-			InputFormat: imageFormat,
-			IsAnimated:  isAnimated,
-			Format:      bhpParams.Format,
-			Grayscale:   bhpParams.Grayscale,
-			Quality:     bhpParams.Quality,
-		})
+	ServeImage(w, r, bhpParams, RedirectResponder)
+}
+
+// ServeImage fetches, compresses and writes the image described by bhpParams,
+// using onError to answer the client when that is not possible
+func ServeImage(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, onError ErrorResponder) {
+	RecordRequest(r)
+	ApplyCredentialSettings(bhpParams, ClientFromRequest(r))
+	modes := CurrentModes()
+	if modes.UseBestCompressionFormat {
+		bhpParams.Formats = BestFormatsFor(strings.Join(r.Header.Values("Accept"), ","))
+	}
+	key := variantKey(bhpParams, modes)
+	validators := UpstreamValidators{}
+
+	// Serve cached variants while they are fresh, and stale ones within
+	// BHP_CACHE_STALE_WHILE_REVALIDATE while they are revalidated in the background.
+	// Older ones are revalidated with the origin before they are served.
+	cached := cachedVariantFor(key)
+	if cached != nil {
+		staleFor := time.Since(cached.Validator.FreshUntil)
+		if staleFor < 0 {
+			serveCachedVariant(w, r, bhpParams, cached, "HIT")
+			return
+		}
+		if staleFor < cacheStaleWhileRevalidate() {
+			serveCachedVariant(w, r, bhpParams, cached, "STALE")
+			if startRevalidation(key) {
+				go revalidateCachedVariant(r.Clone(context.WithoutCancel(r.Context())), *bhpParams, modes, cached)
+			}
+			return
+		}
+		validators = cached.Validator.Upstream
+	}
+
+	// Answer conditional requests for fresh variants without fetching the image,
+	// and revalidate stale ones with the origin
+	remembered := rememberedVariant(key)
+	if cached == nil && remembered != nil && etagMatches(r, remembered.ETag) {
+		if time.Now().Before(remembered.FreshUntil) {
+			writeNotModified(w, bhpParams, remembered.ETag, remembered.CacheControl)
+			log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Not modified: %s\n", bhpParams.Url, remembered.ETag)
+			return
+		}
+		validators = remembered.Upstream
+	}
+
+	imageResponse, err := RequestImageConditional(bhpParams.Url, ForwardedRequestHeader(r), validators)
+	if errors.Is(err, ErrImageTooLarge) {
+		onError.fail(w, r, bhpParams, http.StatusRequestEntityTooLarge, "Image too large", err)
+
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: %s\n > Action: %s\n", bhpParams.Url, err.Error(), onError.Action)
+		return
 	}
 	if err != nil {
-		w.Header().Set("Location", bhpParams.Url)
-		w.WriteHeader(http.StatusFound)
+		onError.fail(w, r, bhpParams, http.StatusBadGateway, "Upstream request failed", err)
 
-		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Info:\n > Error: %s\n > Action: Redirecting to original URL\n",
-			bhpParams.Url, bhpParams.Format, bhpParams.Quality, currentQuality, bhpParams.Grayscale, err.Error())
+		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d\n > Grayscale: %t\n> Info:\n > Error: %s\n > Action: %s\n",
+			bhpParams.Url, bhpParams.Format, bhpParams.Quality, bhpParams.Grayscale, err.Error(), onError.Action)
+		return
+	}
+	if imageResponse.Body != nil {
+		serveNonImage(w, r, bhpParams, imageResponse, onError)
 		return
 	}
+	defer imageResponse.Release()
+	RecordUpstreamBytes(r, imageResponse.UpstreamBytes())
 
-	if !BHP_FORCE_FORMAT && compressedImage.Format == "" {
-		w.Header().Set("Location", bhpParams.Url)
-		w.WriteHeader(http.StatusFound)
+	if imageResponse.NotModified {
+		if cached != nil {
+			cached.Validator = notModifiedValidator(r, imageResponse.ResponseHeaders, cached.Validator)
+			cached.UpdatedAt = time.Now()
+			refreshCachedVariant(key, cached.Validator)
+			rememberVariant(key, cached.Validator)
+			serveCachedVariant(w, r, bhpParams, cached, "REVALIDATED")
+			return
+		}
 
-		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Info:\n > Error: Could not compress image into smaller size than original\n > Action: Redirecting to original URL\n",
-			bhpParams.Url, bhpParams.Format, bhpParams.Quality, currentQuality, bhpParams.Grayscale)
+		validator := notModifiedValidator(r, imageResponse.ResponseHeaders, *remembered)
+		rememberVariant(key, validator)
+		writeNotModified(w, bhpParams, validator.ETag, validator.CacheControl)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Not modified: %s (revalidated)\n", bhpParams.Url, validator.ETag)
 		return
 	}
+	if CacheEnabled() {
+		RecordCacheLookup(false)
+	}
 
-	compressedImageSize := len(compressedImage.Bytes)
-	savedSize := originalImageSize - compressedImageSize
+	validator := newVariantValidator(r, variantETag(key, imageResponse.ResponseHeaders, imageResponse.Bytes, SsimTargetFor(bhpParams) > 0), imageResponse.ResponseHeaders)
+	if etagMatches(r, validator.ETag) {
+		rememberVariant(key, validator)
+		writeNotModified(w, bhpParams, validator.ETag, validator.CacheControl)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Not modified: %s\n", bhpParams.Url, validator.ETag)
+		return
+	}
 
-	if !BHP_FORCE_FORMAT && savedSize <= 0 {
-		w.Header().Set("Location", bhpParams.Url)
-		w.WriteHeader(http.StatusFound)
+	declaredFormat := mediaType(imageResponse.ResponseHeaders.Get("Content-Type"))
+	imageFormat := ImageFormatOf(declaredFormat, imageResponse.Bytes)
+	forceFormat := modes.ForceFormat || bhpParams.ForceFormat
+	originalImageSize := len(imageResponse.Bytes)
+
+	compressedImage, currentQuality, reason, err := compressVariant(bhpParams, imageResponse, modes)
+	if err != nil {
+		onError.fail(w, r, bhpParams, http.StatusUnprocessableEntity, reason, err)
 
-		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Info:\n > Error: Compressed image is not smaller than original\n > Action: Redirecting to original URL\n",
-			bhpParams.Url, bhpParams.Format, bhpParams.Quality, currentQuality, bhpParams.Grayscale)
+		log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Info:\n > Error: %s\n > Action: %s\n",
+			bhpParams.Url, bhpParams.Format, bhpParams.Quality, currentQuality, bhpParams.Grayscale, err.Error(), onError.Action)
 		return
 	}
 
-	skipHeaders := map[string]bool{"transfer-encoding": true, "content-encoding": true, "vary": true}
-	for headerKey, headerValue := range imageResponse.ResponseHeaders {
-		headerKeyLower := strings.ToLower(headerKey)
+	compressedImageSize := len(compressedImage.Bytes)
+	savedSize := originalImageSize - compressedImageSize
 
-		if skipHeaders[headerKeyLower] {
-			continue
-		}
+	header := variantHeader(bhpParams, imageResponse, compressedImage, originalImageSize)
+	if sharedCacheable(imageResponse.RequestHeaders, imageResponse.ResponseHeaders) {
+		storeCachedVariant(&cachedVariant{
+			Key:          key,
+			Url:          bhpParams.Url,
+			Domain:       imageDomain(bhpParams.Url),
+			Bytes:        compressedImage.Bytes,
+			Header:       header.Clone(),
+			OriginalSize: originalImageSize,
+			Validator:    validator,
+			UpdatedAt:    time.Now(),
+		})
+	}
 
-		w.Header().Set(headerKeyLower, headerValue[0]) // Set other headers from the original response
+	for headerKey, headerValues := range header {
+		w.Header()[headerKey] = headerValues
+	}
+	w.Header().Set("ETag", validator.ETag)
+	w.Header().Set("Cache-Control", validator.CacheControl)
+	if CacheEnabled() {
+		w.Header().Set("X-Cache", "MISS")
 	}
-	w.Header().Set("Content-Type", "image/"+compressedImage.Format)
-	w.Header().Set("Content-Length", strconv.Itoa(compressedImageSize))
-	w.Header().Set("X-Original-Size", strconv.Itoa(originalImageSize))
-	w.Header().Set("X-Compressed-Size", strconv.Itoa(compressedImageSize))
-	w.Header().Set("X-Size-Saved", strconv.Itoa(savedSize))
 
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(compressedImage.Bytes); err != nil {
-		http.Error(w, "Failed to write image response: "+err.Error(), http.StatusInternalServerError)
-		log.Println("Error writing image response:", err)
-		return
+	writeVariant(w, r, compressedImage.Bytes)
+	rememberVariant(key, validator)
+	if r.Method != http.MethodHead {
+		RecordServed(r, bhpParams.Url, originalImageSize, compressedImageSize)
+		RecordStats(r, bhpParams.Url, originalImageSize, compressedImageSize)
 	}
 
 	var reqHeaders strings.Builder
@@ -153,28 +234,173 @@ func ProxyHandler(w http.ResponseWriter, r *http.Request) {
 	compressedImageSizePerc := CalcPercentage(int64(compressedImageSize), int64(originalImageSize))
 	savedSizePerc := CalcPercentage(int64(savedSize), int64(originalImageSize))
 
-	formatModifiers := make([]string, 0, 3)
-	if BHP_FORCE_FORMAT {
+	formatModifiers := make([]string, 0, 4)
+	if forceFormat {
 		formatModifiers = append(formatModifiers, "forced")
 	}
-	if BHP_USE_BEST_COMPRESSION_FORMAT {
+	if modes.UseBestCompressionFormat {
 		formatModifiers = append(formatModifiers, "auto")
 	}
-	if isAnimated {
+	if compressedImage.Animated {
 		formatModifiers = append(formatModifiers, "animated")
 	}
+	if bhpParams.Resize.IsSet() {
+		formatModifiers = append(formatModifiers, fmt.Sprintf("resized %s %dx%d", bhpParams.Resize.Type, bhpParams.Resize.Width, bhpParams.Resize.Height))
+	}
 
 	formatInfo := ""
 	if len(formatModifiers) > 0 {
 		formatInfo = " (" + strings.Join(formatModifiers, ", ") + ")"
 	}
 
+	inputInfo := imageFormat
+	if declaredFormat != imageFormat {
+		inputInfo += " (declared as " + declaredFormat + ")"
+	}
+
 	reqHeadersStr := reqHeaders.String()
 	resHeadersStr := resHeaders.String()
-	log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Request headers:\n%s> Response headers:\n%s> Info:\n > Using format: %s%s\n > Original size: %s\n > Compressed size: %s ( %.2f%% )\n > Saved size: %s ( %.2f%% )\n",
+	log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d (%d)\n > Grayscale: %t\n> Request headers:\n%s> Response headers:\n%s> Info:\n > Input format: %s\n > Using format: %s%s\n > Original size: %s\n > Compressed size: %s ( %.2f%% )\n > Saved size: %s ( %.2f%% )\n",
 		bhpParams.Url, bhpParams.Format, bhpParams.Quality, currentQuality, bhpParams.Grayscale,
-		reqHeadersStr, resHeadersStr, compressedImage.Format, formatInfo,
+		reqHeadersStr, resHeadersStr, inputInfo, compressedImage.Format, formatInfo,
 		originalImageSizeStr,
 		compressedImageSizeStr, compressedImageSizePerc,
 		savedSizeStr, savedSizePerc)
 }
+
+// compressVariant compresses the upstream image for bhpParams, returning the
+// failure reason for the dashboard when it cannot be served
+func compressVariant(bhpParams *BhpParams, imageResponse *ImageResponse, modes CompressionModes) (*CompressImageResult, int, string, error) {
+	imageFormat := ImageFormatOf(imageResponse.ResponseHeaders.Get("Content-Type"), imageResponse.Bytes)
+	if bhpParams.Format == "" {
+		bhpParams.Format = OutputFormatForInput(imageFormat)
+	}
+	forceFormat := modes.ForceFormat || bhpParams.ForceFormat
+
+	compressedImage, currentQuality, err := CompressImageForParams(imageResponse.Bytes, imageFormat, bhpParams)
+	if err != nil {
+		return nil, currentQuality, "Compression failed", err
+	}
+
+	if !forceFormat && compressedImage.Format == "" {
+		return nil, currentQuality, "Not smaller than original", fmt.Errorf("could not compress image into smaller size than original")
+	}
+	if !forceFormat && len(compressedImage.Bytes) >= len(imageResponse.Bytes) {
+		return nil, currentQuality, "Not smaller than original", fmt.Errorf("compressed image is not smaller than original")
+	}
+
+	return compressedImage, currentQuality, "", nil
+}
+
+// variantHeader returns the response headers of a compressed image: the forwarded
+// headers of the origin and the sizes of the compressed image
+func variantHeader(bhpParams *BhpParams, imageResponse *ImageResponse, compressedImage *CompressImageResult, originalImageSize int) http.Header {
+	header := forwardedResponseHeader(imageResponse.ResponseHeaders, imageResponse.Proto)
+
+	compressedImageSize := len(compressedImage.Bytes)
+	header.Set("Content-Type", "image/"+compressedImage.Format)
+	header.Set("Content-Length", strconv.Itoa(compressedImageSize))
+	header.Set("X-Original-Size", strconv.Itoa(originalImageSize))
+	header.Set("X-Compressed-Size", strconv.Itoa(compressedImageSize))
+	header.Set("X-Size-Saved", strconv.Itoa(originalImageSize-compressedImageSize))
+	if compressedImage.Quality > 0 {
+		header.Set("X-Bhp-Quality", strconv.Itoa(compressedImage.Quality))
+	}
+	if compressedImage.Ssim > 0 {
+		header.Set("X-Bhp-Ssim", strconv.FormatFloat(compressedImage.Ssim, 'f', 4, 64))
+	}
+	if len(bhpParams.Formats) > 0 {
+		header.Set("Vary", "Accept") // The format was chosen from the formats the client accepts
+	}
+	return header
+}
+
+// writeVariant writes a compressed image whose headers are set, answering Range
+// and If-Range requests with the requested part and HEAD requests without a body
+func writeVariant(w http.ResponseWriter, r *http.Request, imageBytes []byte) {
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(imageBytes))
+}
+
+// serveCachedVariant writes a cached image, or 304 Not Modified when the client already has it
+func serveCachedVariant(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, entry *cachedVariant, cacheStatus string) {
+	RecordCacheLookup(true)
+	w.Header().Set("X-Cache", cacheStatus)
+
+	if etagMatches(r, entry.Validator.ETag) {
+		writeNotModified(w, bhpParams, entry.Validator.ETag, entry.Validator.CacheControl)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Not modified: %s (cache %s)\n", bhpParams.Url, entry.Validator.ETag, strings.ToLower(cacheStatus))
+		return
+	}
+
+	for headerKey, headerValues := range entry.Header {
+		w.Header()[headerKey] = slices.Clone(headerValues)
+	}
+	w.Header().Set("ETag", entry.Validator.ETag)
+	w.Header().Set("Cache-Control", entry.Validator.CacheControl)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.UpdatedAt).Seconds())))
+
+	writeVariant(w, r, entry.Bytes)
+	if r.Method != http.MethodHead {
+		RecordServed(r, bhpParams.Url, entry.OriginalSize, len(entry.Bytes))
+		RecordStats(r, bhpParams.Url, entry.OriginalSize, len(entry.Bytes))
+	}
+
+	log.Printf("\n> Params:\n > URL: %s\n > Format: %s\n > Quality: %d\n > Grayscale: %t\n> Info:\n > Cache: %s\n > Original size: %s\n > Compressed size: %s\n",
+		bhpParams.Url, bhpParams.Format, bhpParams.Quality, bhpParams.Grayscale, strings.ToLower(cacheStatus),
+		FormatSize(int64(entry.OriginalSize)), FormatSize(int64(len(entry.Bytes))))
+}
+
+// revalidateCachedVariant refreshes a stale cached variant in the background with a
+// conditional request to the origin, r is a copy of the request that served it stale.
+// The stale variant is kept when the origin cannot be reached.
+func revalidateCachedVariant(r *http.Request, bhpParams BhpParams, modes CompressionModes, entry *cachedVariant) {
+	defer finishRevalidation(entry.Key)
+
+	imageResponse, err := RequestImageConditional(bhpParams.Url, ForwardedRequestHeader(r), entry.Validator.Upstream)
+	if err != nil {
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: %s\n > Action: Keeping stale cached image\n", bhpParams.Url, err.Error())
+		return
+	}
+	if imageResponse.Body != nil {
+		imageResponse.Body.Close()
+		removeCachedVariant(entry.Key)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: not an image anymore\n > Action: Removing cached image\n", bhpParams.Url)
+		return
+	}
+	defer imageResponse.Release()
+	RecordUpstreamBytes(r, imageResponse.UpstreamBytes())
+
+	if imageResponse.NotModified {
+		validator := notModifiedValidator(r, imageResponse.ResponseHeaders, entry.Validator)
+		refreshCachedVariant(entry.Key, validator)
+		rememberVariant(entry.Key, validator)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Revalidated cached image: %s\n", bhpParams.Url, validator.ETag)
+		return
+	}
+
+	if !sharedCacheable(imageResponse.RequestHeaders, imageResponse.ResponseHeaders) {
+		removeCachedVariant(entry.Key)
+		return
+	}
+
+	compressedImage, _, reason, err := compressVariant(&bhpParams, imageResponse, modes)
+	if err != nil {
+		removeCachedVariant(entry.Key)
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: %s: %s\n > Action: Removing cached image\n", bhpParams.Url, reason, err.Error())
+		return
+	}
+
+	validator := newVariantValidator(r, variantETag(entry.Key, imageResponse.ResponseHeaders, imageResponse.Bytes, SsimTargetFor(&bhpParams) > 0), imageResponse.ResponseHeaders)
+	storeCachedVariant(&cachedVariant{
+		Key:          entry.Key,
+		Url:          entry.Url,
+		Domain:       entry.Domain,
+		Bytes:        compressedImage.Bytes,
+		Header:       variantHeader(&bhpParams, imageResponse, compressedImage, len(imageResponse.Bytes)),
+		OriginalSize: len(imageResponse.Bytes),
+		Validator:    validator,
+		UpdatedAt:    time.Now(),
+	})
+	rememberVariant(entry.Key, validator)
+	log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Refreshed cached image: %s\n", bhpParams.Url, validator.ETag)
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers
+const viaPseudonym = "bandwidth-hero-proxy"
+
+// hopByHopHeaders only apply to a single connection and are never forwarded (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardingHeaders describe the path of the request to the proxy, they are
+// replaced according to BHP_FORWARD_CLIENT_IP
+var forwardingHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// representationHeaders describe the original image or the connection to the
+// origin, so they are never passed to clients with the compressed image
+var representationHeaders = map[string]bool{
+	"accept-ranges":             true,
+	"age":                       true,
+	"alt-svc":                   true,
+	"cache-control":             true,
+	"content-digest":            true,
+	"content-encoding":          true,
+	"content-length":            true,
+	"content-md5":               true,
+	"content-range":             true,
+	"content-type":              true,
+	"digest":                    true,
+	"etag":                      true,
+	"expires":                   true,
+	"last-modified":             true,
+	"pragma":                    true,
+	"repr-digest":               true,
+	"strict-transport-security": true,
+	"vary":                      true,
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers and the ones listed in Connection
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// joinHeaderValues combines the values of a request header into one field
+// value, Cookie is the only request header not joined by commas
+func joinHeaderValues(name string, values []string) string {
+	if strings.EqualFold(name, "Cookie") {
+		return strings.Join(values, "; ")
+	}
+	return strings.Join(values, ", ")
+}
+
+// viaProtocol returns the received-protocol of a Via entry, e.g. "1.1" or "2"
+func viaProtocol(proto string) string {
+	version := strings.TrimPrefix(proto, "HTTP/")
+	if strings.HasPrefix(version, "1.") {
+		return version
+	}
+	return strings.TrimSuffix(version, ".0") // HTTP/2 and HTTP/3 have no minor version
+
+}
+
+// ForwardedRequestHeader returns the client request headers to send to the origin:
+// without hop-by-hop headers and the proxy's own credentials, with the proxy added
+// to Via and X-Forwarded-For set according to BHP_FORWARD_CLIENT_IP
+func ForwardedRequestHeader(r *http.Request) http.Header {
+	header := r.Header.Clone()
+	removeHopByHopHeaders(header)
+
+	if authConfiguration.enabled() {
+		header.Del("Authorization")
+		header.Del("X-Api-Key")
+	}
+
+	forwardedFor := strings.Join(header.Values("X-Forwarded-For"), ", ")
+	for _, name := range forwardingHeaders {
+		header.Del(name)
+	}
+	if BHP_FORWARD_CLIENT_IP {
+		peer, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			peer = r.RemoteAddr
+		}
+
+		// Only the addresses added by trusted proxies are kept, like in ClientIp
+		viaUnixSocket := net.ParseIP(peer) == nil
+		if !viaUnixSocket && !isTrustedProxy(peer) {
+			forwardedFor = ""
+		}
+		if !viaUnixSocket {
+			forwardedFor = strings.TrimPrefix(forwardedFor+", "+peer, ", ")
+		}
+		if forwardedFor != "" {
+			header.Set("X-Forwarded-For", forwardedFor)
+		}
+	}
+
+	header.Add("Via", viaProtocol(r.Proto)+" "+viaPseudonym)
+	return header
+}
+
+// responseHeaderAllowed applies BHP_RESPONSE_HEADERS_ALLOW and BHP_RESPONSE_HEADERS_DENY
+func responseHeaderAllowed(name string) bool {
+	name = strings.ToLower(name)
+
+	allowed := len(allowedResponseHeaders) == 0
+	for _, pattern := range allowedResponseHeaders {
+		if pattern.MatchString(name) {
+			allowed = true
+			break
+		}
+	}
+	for _, pattern := range deniedResponseHeaders {
+		if pattern.MatchString(name) {
+			return false
+		}
+	}
+	return allowed
+}
+
+// forwardedResponseHeader returns the origin response headers that are passed to
+// clients with the compressed image, with every value of multi-valued headers
+func forwardedResponseHeader(upstreamHeaders http.Header, upstreamProto string) http.Header {
+	header := upstreamHeaders.Clone()
+	removeHopByHopHeaders(header)
+
+	for name := range header {
+		if representationHeaders[strings.ToLower(name)] || !responseHeaderAllowed(name) {
+			delete(header, name)
+		}
+	}
+
+	if upstreamProto == "" {
+		upstreamProto = "HTTP/1.1"
+	}
+	header.Add("Via", viaProtocol(upstreamProto)+" "+viaPseudonym)
+	return header
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Addresses returns the UDP addresses of the HTTP/3 listeners: the host and
+// port of every TCP listener of the proxy, so HTTP/3 is served on the same
+// interfaces, with BHP_HTTP3_PORT as port when it is set. When the proxy only
+// listens on Unix sockets, BHP_HTTP3_PORT is required and bound on every interface.
+func http3Addresses(listeners []net.Listener) ([]string, error) {
+	var addresses []string
+	for _, listener := range listeners {
+		tcpAddress, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			continue
+		}
+		port := tcpAddress.Port
+		if BHP_HTTP3_PORT > 0 {
+			port = BHP_HTTP3_PORT
+		}
+		address := net.JoinHostPort(tcpAddress.IP.String(), fmt.Sprint(port))
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		if BHP_HTTP3_PORT == 0 {
+			return nil, fmt.Errorf("BHP_HTTP3_PORT: required when the proxy only listens on Unix sockets")
+		}
+		addresses = append(addresses, fmt.Sprintf(":%d", BHP_HTTP3_PORT))
+	}
+	return addresses, nil
+}
+
+func http3Errors() []error {
+	var errs []error
+	if BHP_HTTP3 && !TlsEnabled() {
+		errs = append(errs, fmt.Errorf("BHP_HTTP3: requires BHP_TLS_CERT and BHP_TLS_KEY, QUIC is always encrypted"))
+	}
+	if BHP_HTTP3_PORT < 0 || BHP_HTTP3_PORT > 65535 {
+		errs = append(errs, fmt.Errorf("BHP_HTTP3_PORT: %d is not a valid port (0-65535)", BHP_HTTP3_PORT))
+	}
+	return errs
+}
+
+// NewHttp3Server returns the HTTP/3 server and its UDP listeners, one per TCP
+// listener of the proxy (see http3Addresses). It shares the handler and the
+// (reloading) certificate of the TLS server. The listeners are served with
+// Serve and must be closed after the server is shut down.
+func NewHttp3Server(handler http.Handler, tlsConfig *tls.Config, listeners []net.Listener) (*http3.Server, []net.PacketConn, error) {
+	addresses, err := http3Addresses(listeners)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	udpListeners := make([]net.PacketConn, 0, len(addresses))
+	for _, address := range addresses {
+		udpListener, err := net.ListenPacket("udp", address)
+		if err != nil {
+			for _, opened := range udpListeners {
+				opened.Close()
+			}
+			return nil, nil, fmt.Errorf("failed to listen on UDP %s: %w", address, err)
+		}
+		udpListeners = append(udpListeners, udpListener)
+	}
+
+	return &http3.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}, udpListeners, nil
+}
+
+// AltSvcMiddleware advertises HTTP/3 to clients connecting over TCP, on the UDP
+// port bound on the interface the client connected to
+func AltSvcMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			if port := http3PortFor(r); port > 0 {
+				w.Header().Set("Alt-Svc", fmt.Sprintf(`%s=":%d"; ma=2592000`, http3.NextProtoH3, port))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// http3PortFor returns the UDP port of the HTTP/3 listener next to the TCP
+// listener the request came in on, 0 when there is none
+func http3PortFor(r *http.Request) int {
+	if BHP_HTTP3_PORT > 0 {
+		return BHP_HTTP3_PORT
+	}
+	if address, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return address.Port
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// testListener is a listener that only has an address
+type testListener struct {
+	net.Listener
+	address net.Addr
+}
+
+func (listener testListener) Addr() net.Addr { return listener.address }
+
+func TestHttp3Addresses(t *testing.T) {
+	previousPort := BHP_HTTP3_PORT
+	t.Cleanup(func() { BHP_HTTP3_PORT = previousPort })
+
+	tcp := func(address string) net.Listener {
+		return testListener{address: net.TCPAddrFromAddrPort(netip.MustParseAddrPort(address))}
+	}
+	unix := testListener{address: &net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}}
+
+	tests := []struct {
+		name      string
+		listeners []net.Listener
+		port      int
+		want      []string
+		wantErr   bool
+	}{
+		{name: "every interface", listeners: []net.Listener{tcp("[::]:8080")}, want: []string{"[::]:8080"}},
+		{name: "specific interfaces", listeners: []net.Listener{tcp("127.0.0.1:8080"), tcp("[::1]:8443"), unix}, want: []string{"127.0.0.1:8080", "[::1]:8443"}},
+		{name: "BHP_HTTP3_PORT", listeners: []net.Listener{tcp("127.0.0.1:8080"), tcp("127.0.0.1:8081")}, port: 9443, want: []string{"127.0.0.1:9443"}},
+		{name: "Unix sockets with BHP_HTTP3_PORT", listeners: []net.Listener{unix}, port: 9443, want: []string{":9443"}},
+		{name: "Unix sockets only", listeners: []net.Listener{unix}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			BHP_HTTP3_PORT = test.port
+			got, err := http3Addresses(test.listeners)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("http3Addresses() error = %v, want error: %t", err, test.wantErr)
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("http3Addresses() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func decodeImgproxySecret(key string, value string) ([]byte, []error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, []error{fmt.Errorf("%s: must be hex-encoded: %v", key, err)}
+	}
+	return decoded, nil
+}
+
+var (
+	imgproxyKey, imgproxyKeyErrors   = decodeImgproxySecret("BHP_IMGPROXY_KEY", BHP_IMGPROXY_KEY)
+	imgproxySalt, imgproxySaltErrors = decodeImgproxySecret("BHP_IMGPROXY_SALT", BHP_IMGPROXY_SALT)
+)
+
+// ImgproxyResponder answers failures with a plain text error like imgproxy does
+var ImgproxyResponder = ErrorResponder{
+	Action: "Responding with imgproxy error",
+	Respond: func(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, err error) {
+		http.Error(w, err.Error(), status)
+	},
+}
+
+// MountImgproxy serves the imgproxy compatible API under BHP_IMGPROXY_PATH_PREFIX
+// and passes every other request to next. It is not registered on the ServeMux,
+// because the mux would clean (and redirect) the "//" of plain source URLs.
+func MountImgproxy(next http.Handler) http.Handler {
+	prefix := strings.TrimRight(BHP_IMGPROXY_PATH_PREFIX, "/")
+	if prefix == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, prefix+"/") || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ImgproxyHandler(w, r, strings.TrimPrefix(r.URL.EscapedPath(), prefix))
+	})
+}
+
+// ImgproxyHandler handles /<signature>/<processing options>/<source url> paths
+func ImgproxyHandler(w http.ResponseWriter, r *http.Request, path string) {
+	// Without an imgproxy key and salt any signature is accepted, and "sig" only
+	// covers the query, so URL signing requires imgproxy signatures
+	if len(urlSigningKeys) > 0 && len(imgproxyKey) == 0 && len(imgproxySalt) == 0 {
+		forbidUnsigned(w, r, fmt.Errorf("imgproxy URLs must be signed with BHP_IMGPROXY_KEY and BHP_IMGPROXY_SALT when BHP_URL_SIGNING_KEYS is set"))
+		return
+	}
+
+	bhpParams, status, err := ParseImgproxyPath(path)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		RecordFailure("Invalid imgproxy URL", ImgproxyResponder.Action)
+		log.Printf("\n> Imgproxy path: %s\n> Info:\n > Error: %s\n", path, err.Error())
+		return
+	}
+
+	ServeImage(w, r, bhpParams, ImgproxyResponder)
+}
+
+// ParseImgproxyPath verifies the signature of an imgproxy path and parses its
+// processing options into BhpParams, returning the HTTP status to use on error
+func ParseImgproxyPath(path string) (*BhpParams, int, error) {
+	signature, signedPath, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !found || signedPath == "" {
+		return nil, http.StatusNotFound, fmt.Errorf("invalid URL: missing source URL")
+	}
+	signedPath = "/" + signedPath
+
+	if err := VerifyImgproxySignature(signature, signedPath); err != nil {
+		return nil, http.StatusForbidden, err
+	}
+
+	bhpParams := &BhpParams{
+		Quality:     80,
+		ForceFormat: true, // imgproxy always serves the processed image
+	}
+	dpr := 1.0
+
+	segments := strings.Split(strings.TrimPrefix(signedPath, "/"), "/")
+	for i, segment := range segments {
+		if segment == "plain" {
+			sourceUrl, extension := cutExtension(strings.Join(segments[i+1:], "/"), "@")
+			unescapedUrl, err := url.PathUnescape(sourceUrl)
+			if err != nil {
+				return nil, http.StatusNotFound, fmt.Errorf("invalid URL: invalid plain source URL: %v", err)
+			}
+			return finishImgproxyParams(bhpParams, dpr, unescapedUrl, extension)
+		}
+
+		name, args, isOption := strings.Cut(segment, ":")
+		if !isOption {
+			// Base64 encoded source URLs may be split with slashes
+			encodedUrl, extension := cutExtension(strings.Join(segments[i:], ""), ".")
+			decodedUrl, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encodedUrl, "="))
+			if err != nil {
+				return nil, http.StatusNotFound, fmt.Errorf("invalid URL: invalid encoded source URL: %v", err)
+			}
+			return finishImgproxyParams(bhpParams, dpr, string(decodedUrl), extension)
+		}
+
+		if err := applyImgproxyOption(bhpParams, &dpr, name, strings.Split(args, ":")); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid processing option %q: %v", segment, err)
+		}
+	}
+
+	return nil, http.StatusNotFound, fmt.Errorf("invalid URL: missing source URL")
+}
+
+// VerifyImgproxySignature checks the HMAC-SHA256 signature of the path,
+// any signature is accepted when no key and salt are configured
+func VerifyImgproxySignature(signature string, signedPath string) error {
+	if len(imgproxyKey) == 0 && len(imgproxySalt) == 0 {
+		return nil
+	}
+
+	expected := SignImgproxyPath(signedPath)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// SignImgproxyPath computes the imgproxy signature of a path (starting after the signature)
+func SignImgproxyPath(signedPath string) string {
+	mac := hmac.New(sha256.New, imgproxyKey)
+	mac.Write(imgproxySalt)
+	mac.Write([]byte(signedPath))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutExtension(value string, separator string) (string, string) {
+	index := strings.LastIndex(value, separator)
+	if index < 0 {
+		return value, ""
+	}
+	// Do not mistake the dot of a domain or path for an extension in plain URLs
+	if separator == "." && strings.Contains(value[index:], "/") {
+		return value, ""
+	}
+	return value[:index], value[index+1:]
+}
+
+// finishImgproxyParams sets the source URL and format, and scales the target size
+// by dpr once every resizing option is known, whatever their order
+func finishImgproxyParams(bhpParams *BhpParams, dpr float64, sourceUrl string, extension string) (*BhpParams, int, error) {
+	if sourceUrl == "" {
+		return nil, http.StatusNotFound, fmt.Errorf("invalid URL: missing source URL")
+	}
+	if !strings.HasPrefix(sourceUrl, "http://") && !strings.HasPrefix(sourceUrl, "https://") {
+		return nil, http.StatusNotFound, fmt.Errorf("invalid URL: unsupported source URL scheme: %s", sourceUrl)
+	}
+	bhpParams.Url = sourceUrl
+	bhpParams.Resize.Width = int(float64(bhpParams.Resize.Width) * dpr)
+	bhpParams.Resize.Height = int(float64(bhpParams.Resize.Height) * dpr)
+
+	if extension != "" {
+		if err := setImgproxyFormat(bhpParams, extension); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	return bhpParams, http.StatusOK, nil
+}
+
+func setImgproxyFormat(bhpParams *BhpParams, extension string) error {
+	format := strings.ToLower(extension)
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if _, ok := OutputFormats[format]; !ok {
+		return fmt.Errorf("unsupported output format: %s", extension)
+	}
+	bhpParams.Format = format
+	return nil
+}
+
+func applyImgproxyOption(bhpParams *BhpParams, dpr *float64, name string, args []string) error {
+	var err error
+
+	switch name {
+	case "resize", "rs":
+		if len(args) > 0 && args[0] != "" {
+			err = setImgproxyResizingType(bhpParams, args[0])
+		}
+		if err == nil && len(args) > 1 {
+			err = setImgproxySize(bhpParams, args[1:])
+		}
+	case "size", "s":
+		err = setImgproxySize(bhpParams, args)
+	case "resizing_type", "rt":
+		err = setImgproxyResizingType(bhpParams, args[0])
+	case "width", "w":
+		bhpParams.Resize.Width, err = parseImgproxyDimension(args[0])
+	case "height", "h":
+		bhpParams.Resize.Height, err = parseImgproxyDimension(args[0])
+	case "enlarge", "el":
+		bhpParams.Resize.Enlarge = parseImgproxyBool(args[0])
+	case "gravity", "g":
+		gravity := args[0]
+		if gravity == "fp" {
+			gravity = "ce" // Focus points are not supported, crop around the centre
+		}
+		if !Gravities[gravity] {
+			return fmt.Errorf("unknown gravity: %s", args[0])
+		}
+		bhpParams.Resize.Gravity = gravity
+	case "quality", "q":
+		quality, parseErr := strconv.Atoi(args[0])
+		if parseErr != nil || quality < 0 || quality > 100 {
+			return fmt.Errorf("quality must be between 0 and 100")
+		}
+		if quality > 0 {
+			bhpParams.Quality = quality
+		}
+	case "format", "f", "ext":
+		err = setImgproxyFormat(bhpParams, args[0])
+	case "saturation", "sa":
+		saturation, parseErr := strconv.ParseFloat(args[0], 64)
+		switch {
+		case parseErr != nil:
+			return fmt.Errorf("invalid saturation: %s", args[0])
+		case saturation == 0:
+			bhpParams.Grayscale = true
+		case saturation != 1:
+			return fmt.Errorf("only saturation 0 (grayscale) and 1 are supported")
+		}
+	case "dpr":
+		parsed, parseErr := strconv.ParseFloat(args[0], 64)
+		if parseErr != nil || parsed <= 0 {
+			return fmt.Errorf("invalid dpr: %s", args[0])
+		}
+		*dpr = parsed
+	case "expires", "exp":
+		timestamp, parseErr := strconv.ParseInt(args[0], 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid expiration timestamp: %s", args[0])
+		}
+		if time.Now().Unix() > timestamp {
+			return fmt.Errorf("URL has expired")
+		}
+	case "strip_metadata", "sm":
+		// Metadata is always stripped
+	case "cachebuster", "cb", "filename", "fn", "return_attachment", "att":
+		// Only affect caching or the download name, nothing to do
+	default:
+		return fmt.Errorf("unknown processing option: %s", name)
+	}
+
+	return err
+}
+
+func setImgproxyResizingType(bhpParams *BhpParams, resizingType string) error {
+	if !ResizeTypes[resizingType] {
+		return fmt.Errorf("unknown resizing type: %s", resizingType)
+	}
+	bhpParams.Resize.Type = resizingType
+	return nil
+}
+
+func setImgproxySize(bhpParams *BhpParams, args []string) error {
+	var err error
+	if len(args) > 0 && args[0] != "" {
+		if bhpParams.Resize.Width, err = parseImgproxyDimension(args[0]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 1 && args[1] != "" {
+		if bhpParams.Resize.Height, err = parseImgproxyDimension(args[1]); err != nil {
+			return err
+		}
+	}
+	if len(args) > 2 && args[2] != "" {
+		bhpParams.Resize.Enlarge = parseImgproxyBool(args[2])
+	}
+	return nil
+}
+
+func parseImgproxyDimension(value string) (int, error) {
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension < 0 || dimension > maxDimension {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return dimension, nil
+}
+
+func parseImgproxyBool(value string) bool {
+	return value == "1" || value == "t" || value == "true"
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseImgproxyPath(t *testing.T) {
+	encodedUrl := base64.RawURLEncoding.EncodeToString([]byte("https://example.com/images/cat.png"))
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name    string
+		path    string
+		want    BhpParams
+		status  int
+		wantErr bool
+	}{
+		{
+			name: "plain source URL with extension",
+			path: "/insecure/rs:fill:300:200/q:60/plain/https://example.com/cat.jpg@webp",
+			want: BhpParams{Url: "https://example.com/cat.jpg", Format: "webp", Quality: 60, ForceFormat: true, Resize: ResizeOptions{Type: "fill", Width: 300, Height: 200}},
+		},
+		{
+			name: "escaped plain source URL",
+			path: "/insecure/plain/https%3A%2F%2Fexample.com%2Fcat.jpg%3Fv%3D2",
+			want: BhpParams{Url: "https://example.com/cat.jpg?v=2", Quality: 80, ForceFormat: true},
+		},
+		{
+			name: "base64 source URL split by slashes",
+			path: "/insecure/w:100/" + encodedUrl[:10] + "/" + encodedUrl[10:] + ".avif",
+			want: BhpParams{Url: "https://example.com/images/cat.png", Format: "avif", Quality: 80, ForceFormat: true, Resize: ResizeOptions{Width: 100}},
+		},
+		{
+			name: "grayscale, gravity and enlarge",
+			path: "/insecure/sa:0/g:fp/el:1/s:50:0/plain/http://example.com/cat.gif",
+			want: BhpParams{Url: "http://example.com/cat.gif", Quality: 80, Grayscale: true, ForceFormat: true, Resize: ResizeOptions{Width: 50, Enlarge: true, Gravity: "ce"}},
+		},
+		{
+			name: "dpr before the size",
+			path: "/insecure/dpr:2/rs:fit:300:200/plain/https://example.com/cat.jpg",
+			want: BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: ResizeOptions{Type: "fit", Width: 600, Height: 400}},
+		},
+		{
+			name: "dpr after the size",
+			path: "/insecure/rs:fit:300:200/dpr:2/plain/https://example.com/cat.jpg",
+			want: BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: ResizeOptions{Type: "fit", Width: 600, Height: 400}},
+		},
+		{
+			name: "quality 0 keeps the default",
+			path: "/insecure/q:0/plain/https://example.com/cat.jpg@jpg",
+			want: BhpParams{Url: "https://example.com/cat.jpg", Format: "jpeg", Quality: 80, ForceFormat: true},
+		},
+		{name: "missing source URL", path: "/insecure/rs:fit:300:200", status: http.StatusNotFound, wantErr: true},
+		{name: "unsupported scheme", path: "/insecure/plain/ftp://example.com/cat.jpg", status: http.StatusNotFound, wantErr: true},
+		{name: "unknown option", path: "/insecure/blur:5/plain/https://example.com/cat.jpg", status: http.StatusBadRequest, wantErr: true},
+		{name: "unknown resizing type", path: "/insecure/rt:stretch/plain/https://example.com/cat.jpg", status: http.StatusBadRequest, wantErr: true},
+		{name: "invalid dpr", path: "/insecure/dpr:0/plain/https://example.com/cat.jpg", status: http.StatusBadRequest, wantErr: true},
+		{name: "unsupported format", path: "/insecure/plain/https://example.com/cat.jpg@bmp", status: http.StatusBadRequest, wantErr: true},
+		{name: "expired", path: "/insecure/exp:" + expired + "/plain/https://example.com/cat.jpg", status: http.StatusBadRequest, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bhpParams, status, err := ParseImgproxyPath(test.path)
+			if test.wantErr {
+				if err == nil || status != test.status {
+					t.Fatalf("ParseImgproxyPath(%q) = %+v, %d, %v, want status %d and an error", test.path, bhpParams, status, err, test.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseImgproxyPath(%q) error: %v", test.path, err)
+			}
+			if !reflect.DeepEqual(*bhpParams, test.want) {
+				t.Errorf("ParseImgproxyPath(%q) = %+v, want %+v", test.path, *bhpParams, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyImgproxySignature(t *testing.T) {
+	previousKey, previousSalt := imgproxyKey, imgproxySalt
+	t.Cleanup(func() { imgproxyKey, imgproxySalt = previousKey, previousSalt })
+	imgproxyKey, _ = hex.DecodeString("943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881")
+	imgproxySalt, _ = hex.DecodeString("520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5")
+
+	// Keys of the imgproxy documentation, the signature computed with Python's hmac module
+	signedPath := "/rs:fill:300:400:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png"
+	if got := SignImgproxyPath(signedPath); got != "90UxdwGRAI2bpLSHKkZculJau5ahfxfS0h3fMuQAf40" {
+		t.Fatalf("SignImgproxyPath() = %q", got)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{name: "valid signature", path: "/90UxdwGRAI2bpLSHKkZculJau5ahfxfS0h3fMuQAf40" + signedPath},
+		{name: "insecure", path: "/insecure" + signedPath, wantErr: true},
+		{name: "tampered options", path: "/90UxdwGRAI2bpLSHKkZculJau5ahfxfS0h3fMuQAf40/rs:fill:3000:4000:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, status, err := ParseImgproxyPath(test.path)
+			if test.wantErr != (err != nil) {
+				t.Fatalf("ParseImgproxyPath(%q) error = %v, want error: %t", test.path, err, test.wantErr)
+			}
+			if test.wantErr && status != http.StatusForbidden {
+				t.Errorf("ParseImgproxyPath(%q) status = %d, want %d", test.path, status, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFd is the first file descriptor passed by systemd socket activation
+const systemdFirstFd = 3
+
+// systemdAdminFdName is the FileDescriptorName= of the socket unit to use for the admin API
+const systemdAdminFdName = "admin"
+
+// Listeners are the sockets the proxy and the admin API are served on
+type Listeners struct {
+	Proxy []net.Listener
+	Admin net.Listener // nil when the admin API is disabled
+}
+
+func (listeners *Listeners) Close() {
+	for _, listener := range listeners.Proxy {
+		listener.Close()
+	}
+	if listeners.Admin != nil {
+		listeners.Admin.Close()
+	}
+}
+
+// ProxyAddresses returns BHP_LISTEN, or all interfaces on BHP_PORT when it is empty
+func ProxyAddresses() []string {
+	if len(BHP_LISTEN) > 0 {
+		return BHP_LISTEN
+	}
+	return []string{fmt.Sprintf(":%d", BHP_PORT)}
+}
+
+// OpenListeners uses the sockets passed by systemd (LISTEN_FDS) when there are any,
+// and listens on ProxyAddresses and BHP_ADMIN_ADDR otherwise. A systemd socket
+// named "admin" is used for the admin API.
+func OpenListeners() (*Listeners, error) {
+	listeners := &Listeners{}
+
+	systemdListeners, err := SystemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	for name, listener := range systemdListeners {
+		if name == systemdAdminFdName && listeners.Admin == nil {
+			listeners.Admin = listener
+			continue
+		}
+		listeners.Proxy = append(listeners.Proxy, listener)
+	}
+
+	if len(listeners.Proxy) == 0 {
+		for _, address := range ProxyAddresses() {
+			listener, err := Listen(address)
+			if err != nil {
+				listeners.Close()
+				return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+			}
+			listeners.Proxy = append(listeners.Proxy, listener)
+		}
+	}
+
+	if listeners.Admin == nil && BHP_ADMIN_ADDR != "" {
+		listener, err := Listen(BHP_ADMIN_ADDR)
+		if err != nil {
+			listeners.Close()
+			return nil, fmt.Errorf("failed to listen on %s: %v", BHP_ADMIN_ADDR, err)
+		}
+		listeners.Admin = listener
+	}
+
+	return listeners, nil
+}
+
+// SystemdListeners returns the sockets passed by systemd socket activation,
+// keyed by their name (LISTEN_FDNAMES) or their file descriptor number
+func SystemdListeners() (map[string]net.Listener, error) {
+	listeners := map[string]net.Listener{}
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// Child processes must not take over the sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := range count {
+		fd := systemdFirstFd + i
+		name := strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" && listeners[names[i]] == nil {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		file.Close() // FileListener works on a duplicate
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s (fd %d) is not a stream socket: %v", name, fd, err)
+		}
+
+		log.Printf("Info: using systemd socket %s (%s)\n", name, listener.Addr())
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+func unixSocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(BHP_UNIX_SOCKET_MODE, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("BHP_UNIX_SOCKET_MODE: must be an octal file mode like 0660, got %q", BHP_UNIX_SOCKET_MODE)
+	}
+	return os.FileMode(mode), nil
+}
+
+func listenErrors() []error {
+	var errs []error
+
+	if _, err := unixSocketMode(); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, address := range BHP_LISTEN {
+		if err := validateListenAddress(address); err != nil {
+			errs = append(errs, fmt.Errorf("BHP_LISTEN: %v", err))
+		}
+	}
+	if BHP_ADMIN_ADDR != "" {
+		if err := validateListenAddress(BHP_ADMIN_ADDR); err != nil {
+			errs = append(errs, fmt.Errorf("BHP_ADMIN_ADDR: %v", err))
+		}
+	}
+
+	return errs
+}
+
+func validateListenAddress(address string) error {
+	if socketPath, isUnix := strings.CutPrefix(address, "unix:"); isUnix {
+		if socketPath == "" {
+			return fmt.Errorf("missing socket path in %q", address)
+		}
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, expected host:port, [ipv6]:port or unix:/path", address)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || portNumber < 0 || portNumber > 65535 {
+		return fmt.Errorf("invalid port in %q", address)
+	}
+	return nil
+}
+
+// Listen listens on a TCP address, or on a Unix socket for "unix:/path" addresses
+func Listen(address string) (net.Listener, error) {
+	socketPath, isUnix := strings.CutPrefix(address, "unix:")
+	if !isUnix {
+		return net.Listen("tcp", address)
+	}
+
+	// A socket left behind by a previous run would make listening fail
+	if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket %s: %v", socketPath, err)
+		}
+	}
+
+	mode, err := unixSocketMode()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions of socket %s: %v", socketPath, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,268 @@
+package utils
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMetricsDomains bounds the live per-domain counters, further domains are counted as "other"
+const maxMetricsDomains = 10000
+
+type failureKey struct {
+	Reason string
+	Action string
+}
+
+type FailureMetrics struct {
+	Reason string `json:"reason"`
+	Action string `json:"action"`
+	Count  int64  `json:"count"`
+}
+
+type FlareSolverrMetrics struct {
+	Enabled   bool      `json:"enabled"`
+	Requests  int64     `json:"requests"`
+	Failures  int64     `json:"failures"`
+	LastAt    time.Time `json:"last_at"`
+	LastError string    `json:"last_error"`
+}
+
+// ProtocolMetrics are the requests and served bytes per HTTP version
+type ProtocolMetrics struct {
+	Protocol    string `json:"protocol"`
+	Requests    int64  `json:"requests"`
+	ServedBytes int64  `json:"served_bytes"`
+}
+
+// CacheMetrics are the hit and miss counters of the image cache
+type CacheMetrics struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Entries   int   `json:"entries"`
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+// MetricsSnapshot is the live state of the proxy since it was started
+type MetricsSnapshot struct {
+	Time              time.Time           `json:"time"`
+	UptimeSeconds     int64               `json:"uptime_seconds"`
+	Requests          int64               `json:"requests"`
+	RequestsPerSecond float64             `json:"requests_per_second"` // Averaged over the last 10 seconds
+	RequestsPerMinute int64               `json:"requests_per_minute"`
+	Served            StatsTotals         `json:"served"`
+	Passthroughs      int64               `json:"passthroughs"` // Non-images served unchanged, included in Served
+	SavingsRatio      float64             `json:"savings_ratio"`
+	TopDomains        []DomainStats       `json:"top_domains"`
+	Failures          []FailureMetrics    `json:"failures"`
+	Protocols         []ProtocolMetrics   `json:"protocols"`
+	Cache             *CacheMetrics       `json:"cache"` // nil when no cache is configured
+	FlareSolverr      FlareSolverrMetrics `json:"flaresolverr"`
+	StatsPath         string              `json:"stats_path"` // Historical stats, empty when disabled
+}
+
+var metrics = struct {
+	sync.Mutex
+	started      time.Time
+	requests     int64
+	perSecond    [60]int64 // Requests of the last 60 seconds, indexed by unix time % 60
+	perSecondAt  [60]int64 // Unix time the perSecond slot belongs to
+	served       StatsTotals
+	passthroughs int64
+	domains      map[string]*StatsTotals
+	failures     map[failureKey]int64
+	protocols    map[string]*ProtocolMetrics
+	cache        CacheMetrics
+	flareSolverr FlareSolverrMetrics
+}{
+	started:   time.Now(),
+	domains:   map[string]*StatsTotals{},
+	failures:  map[failureKey]int64{},
+	protocols: map[string]*ProtocolMetrics{},
+}
+
+// protocolMetrics returns the counters of the HTTP version of the request,
+// the metrics lock must be held
+func protocolMetrics(r *http.Request) *ProtocolMetrics {
+	protocol, exists := metrics.protocols[r.Proto]
+	if !exists {
+		protocol = &ProtocolMetrics{Protocol: r.Proto}
+		metrics.protocols[r.Proto] = protocol
+	}
+	return protocol
+}
+
+// RecordRequest counts an image request for the request rate
+func RecordRequest(r *http.Request) {
+	now := time.Now().Unix()
+	slot := now % 60
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.requests++
+	protocolMetrics(r).Requests++
+	if metrics.perSecondAt[slot] != now {
+		metrics.perSecondAt[slot] = now
+		metrics.perSecond[slot] = 0
+	}
+	metrics.perSecond[slot]++
+}
+
+// imageDomain returns the lowercase host name of the image URL
+func imageDomain(imageUrl string) string {
+	if parsedUrl, err := url.Parse(imageUrl); err == nil && parsedUrl.Hostname() != "" {
+		return strings.ToLower(parsedUrl.Hostname())
+	}
+	return "unknown"
+}
+
+// RecordServed counts a successfully served image
+func RecordServed(r *http.Request, imageUrl string, originalSize int, compressedSize int) {
+	domain := imageDomain(imageUrl)
+	served := StatsTotals{
+		Requests:        1,
+		OriginalBytes:   int64(originalSize),
+		CompressedBytes: int64(compressedSize),
+		SavedBytes:      int64(originalSize - compressedSize),
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.served.add(served)
+	protocolMetrics(r).ServedBytes += int64(compressedSize)
+	totals, exists := metrics.domains[domain]
+	if !exists {
+		if len(metrics.domains) >= maxMetricsDomains {
+			domain = "other"
+		}
+		if totals = metrics.domains[domain]; totals == nil {
+			totals = &StatsTotals{}
+			metrics.domains[domain] = totals
+		}
+	}
+	totals.add(served)
+}
+
+// RecordFailure counts a request that was not answered with a compressed image
+func RecordFailure(reason string, action string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.failures[failureKey{Reason: reason, Action: action}]++
+}
+
+// RecordPassthrough counts a non-image served unchanged
+func RecordPassthrough() {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.passthroughs++
+}
+
+// RecordCacheLookup counts an image request served from the cache, or one that was not cached
+func RecordCacheLookup(hit bool) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if hit {
+		metrics.cache.Hits++
+	} else {
+		metrics.cache.Misses++
+	}
+}
+
+// RecordFlareSolverr counts a FlareSolverr challenge solving attempt
+func RecordFlareSolverr(err error) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.flareSolverr.Requests++
+	metrics.flareSolverr.LastAt = time.Now()
+	if err != nil {
+		metrics.flareSolverr.Failures++
+		metrics.flareSolverr.LastError = err.Error()
+	}
+}
+
+// Metrics returns the current live metrics
+func Metrics() MetricsSnapshot {
+	now := time.Now()
+	cacheEntries, cacheBytes := cacheUsage()
+
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	snapshot := MetricsSnapshot{
+		Time:          now,
+		UptimeSeconds: int64(now.Sub(metrics.started).Seconds()),
+		Requests:      metrics.requests,
+		Served:        metrics.served,
+		Passthroughs:  metrics.passthroughs,
+		FlareSolverr:  metrics.flareSolverr,
+	}
+	snapshot.FlareSolverr.Enabled = strings.TrimSpace(BHP_FLARESOLVERR_URL) != ""
+	if BHP_STATS_DB != "" {
+		snapshot.StatsPath = BHP_STATS_PATH
+	}
+	if CacheEnabled() {
+		cache := metrics.cache
+		cache.Entries, cache.SizeBytes = cacheEntries, cacheBytes
+		snapshot.Cache = &cache
+	}
+
+	unixNow := now.Unix()
+	var lastTenSeconds int64
+	for slot, at := range metrics.perSecondAt {
+		// The current second is still counting, so it is left out of the rates
+		if at >= unixNow || at < unixNow-60 {
+			continue
+		}
+		snapshot.RequestsPerMinute += metrics.perSecond[slot]
+		if at >= unixNow-10 {
+			lastTenSeconds += metrics.perSecond[slot]
+		}
+	}
+	snapshot.RequestsPerSecond = float64(lastTenSeconds) / 10
+
+	if metrics.served.OriginalBytes > 0 {
+		snapshot.SavingsRatio = float64(metrics.served.SavedBytes) / float64(metrics.served.OriginalBytes)
+	}
+
+	snapshot.TopDomains = make([]DomainStats, 0, len(metrics.domains))
+	for domain, totals := range metrics.domains {
+		snapshot.TopDomains = append(snapshot.TopDomains, DomainStats{Domain: domain, StatsTotals: *totals})
+	}
+	sort.Slice(snapshot.TopDomains, func(i, j int) bool {
+		if snapshot.TopDomains[i].Requests != snapshot.TopDomains[j].Requests {
+			return snapshot.TopDomains[i].Requests > snapshot.TopDomains[j].Requests
+		}
+		return snapshot.TopDomains[i].Domain < snapshot.TopDomains[j].Domain
+	})
+	if len(snapshot.TopDomains) > 10 {
+		snapshot.TopDomains = snapshot.TopDomains[:10]
+	}
+
+	snapshot.Failures = make([]FailureMetrics, 0, len(metrics.failures))
+	for key, count := range metrics.failures {
+		snapshot.Failures = append(snapshot.Failures, FailureMetrics{Reason: key.Reason, Action: key.Action, Count: count})
+	}
+	sort.Slice(snapshot.Failures, func(i, j int) bool {
+		if snapshot.Failures[i].Count != snapshot.Failures[j].Count {
+			return snapshot.Failures[i].Count > snapshot.Failures[j].Count
+		}
+		return snapshot.Failures[i].Reason < snapshot.Failures[j].Reason
+	})
+
+	snapshot.Protocols = make([]ProtocolMetrics, 0, len(metrics.protocols))
+	for _, protocol := range metrics.protocols {
+		snapshot.Protocols = append(snapshot.Protocols, *protocol)
+	}
+	sort.Slice(snapshot.Protocols, func(i, j int) bool {
+		return snapshot.Protocols[i].Protocol < snapshot.Protocols[j].Protocol
+	})
+
+	return snapshot
+}
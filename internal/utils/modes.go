@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CompressionModes are the compression modes that can be changed at runtime
+type CompressionModes struct {
+	ForceFormat              bool `json:"force_format"`
+	UseBestCompressionFormat bool `json:"use_best_compression_format"`
+	AutoDecrementQuality     bool `json:"auto_decrement_quality"`
+}
+
+// modesMu guards BHP_FORCE_FORMAT, BHP_USE_BEST_COMPRESSION_FORMAT and
+// BHP_AUTO_DECREMENT_QUALITY once the server is running
+var modesMu sync.RWMutex
+
+func CurrentModes() CompressionModes {
+	modesMu.RLock()
+	defer modesMu.RUnlock()
+
+	return CompressionModes{
+		ForceFormat:              BHP_FORCE_FORMAT,
+		UseBestCompressionFormat: BHP_USE_BEST_COMPRESSION_FORMAT,
+		AutoDecrementQuality:     BHP_AUTO_DECREMENT_QUALITY,
+	}
+}
+
+// SetModes switches the compression modes, unless they conflict
+func SetModes(modes CompressionModes) []error {
+	if errs := modesErrors(modes); len(errs) > 0 {
+		return errs
+	}
+
+	modesMu.Lock()
+	defer modesMu.Unlock()
+
+	BHP_FORCE_FORMAT = modes.ForceFormat
+	BHP_USE_BEST_COMPRESSION_FORMAT = modes.UseBestCompressionFormat
+	BHP_AUTO_DECREMENT_QUALITY = modes.AutoDecrementQuality
+	return nil
+}
+
+func modesErrors(modes CompressionModes) []error {
+	var errs []error
+
+	if modes.ForceFormat && modes.UseBestCompressionFormat {
+		errs = append(errs, fmt.Errorf("BHP_FORCE_FORMAT and BHP_USE_BEST_COMPRESSION_FORMAT cannot be both enabled at the same time"))
+	}
+
+	return errs
+}
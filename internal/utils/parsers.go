@@ -29,10 +29,18 @@ func ParseParams(r *http.Request) (*BhpParams, error) {
 		}
 	}
 
+	ssim := 0.0 // BHP_SSIM_TARGET applies
+	if ssimStr := query.Get("ssim"); ssimStr != "" {
+		if parsedSsim, err := strconv.ParseFloat(ssimStr, 64); err == nil && parsedSsim > 0 && parsedSsim < 1 {
+			ssim = parsedSsim
+		}
+	}
+
 	return &BhpParams{
 		Url:       url,
 		Format:    format,
 		Grayscale: grayscale,
 		Quality:   quality,
+		Ssim:      ssim,
 	}, nil
 }
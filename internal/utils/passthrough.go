@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// passthroughHeaders describe the content itself, so they stay valid when it is passed through unchanged
+var passthroughHeaders = []string{"Cache-Control", "Expires", "Last-Modified"}
+
+var passthroughMaxSize, passthroughMaxSizeErrors = parseSizeOption("BHP_PASSTHROUGH_MAX_SIZE", BHP_PASSTHROUGH_MAX_SIZE)
+
+func nonImagePolicyErrors() []error {
+	errs := append([]error{}, passthroughMaxSizeErrors...)
+	if BHP_NON_IMAGE_POLICY != "passthrough" && BHP_NON_IMAGE_POLICY != "redirect" {
+		errs = append(errs, fmt.Errorf("BHP_NON_IMAGE_POLICY: must be passthrough or redirect, got %q", BHP_NON_IMAGE_POLICY))
+	}
+	return errs
+}
+
+// serveNonImage answers a request whose URL is not an image, according to
+// BHP_NON_IMAGE_POLICY: the content is streamed to the client unchanged, or
+// onError sends the client to the original URL. The content never reaches vips.
+func serveNonImage(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, imageResponse *ImageResponse, onError ErrorResponder) {
+	defer imageResponse.Body.Close()
+
+	contentType := imageResponse.ResponseHeaders.Get("Content-Type")
+	contentLength := int64(-1) // Unknown once the body is decoded
+	if imageResponse.ResponseHeaders.Get("Content-Encoding") == "" {
+		if length, err := strconv.ParseInt(imageResponse.ResponseHeaders.Get("Content-Length"), 10, 64); err == nil {
+			contentLength = length
+		}
+	}
+
+	var err error
+	if BHP_NON_IMAGE_POLICY != "passthrough" {
+		err = fmt.Errorf("content type %q is not an image", contentType)
+	} else if passthroughMaxSize > 0 && contentLength > passthroughMaxSize {
+		err = fmt.Errorf("content of %s exceeds BHP_PASSTHROUGH_MAX_SIZE", FormatSize(contentLength))
+	}
+	if err != nil {
+		onError.fail(w, r, bhpParams, http.StatusUnsupportedMediaType, "Not an image", err)
+
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: %s\n > Action: %s\n", bhpParams.Url, err.Error(), onError.Action)
+		return
+	}
+
+	for headerKey, headerValues := range forwardedResponseHeader(imageResponse.ResponseHeaders, imageResponse.Proto) {
+		w.Header()[headerKey] = headerValues
+	}
+	for _, name := range passthroughHeaders {
+		if values := imageResponse.ResponseHeaders.Values(name); len(values) > 0 {
+			w.Header()[name] = values
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+	// The content is served from the proxy's origin, so it must not be able to run scripts there
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	body := io.Reader(imageResponse.Body)
+	if passthroughMaxSize > 0 {
+		body = io.LimitReader(body, passthroughMaxSize)
+	}
+
+	w.WriteHeader(imageResponse.StatusCode)
+	if r.Method == http.MethodHead {
+		return // The origin already sent a body, it is not read
+	}
+	written, err := io.Copy(w, body)
+	RecordUpstreamBytes(r, imageResponse.UpstreamBytes())
+	RecordPassthrough()
+	RecordServed(r, bhpParams.Url, int(written), int(written))
+	RecordStats(r, bhpParams.Url, int(written), int(written))
+
+	if err == nil && passthroughMaxSize > 0 && written == passthroughMaxSize {
+		if n, _ := io.ReadFull(imageResponse.Body, make([]byte, 1)); n > 0 {
+			err = fmt.Errorf("content exceeds BHP_PASSTHROUGH_MAX_SIZE")
+		}
+	}
+	if err != nil {
+		log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Error: %s\n > Action: Aborting passthrough after %s\n", bhpParams.Url, err.Error(), FormatSize(written))
+		panic(http.ErrAbortHandler) // The client must not take the truncated content as complete
+	}
+
+	log.Printf("\n> Params:\n > URL: %s\n> Info:\n > Input format: %s (not an image)\n > Passed through: %s\n", bhpParams.Url, contentType, FormatSize(written))
+}
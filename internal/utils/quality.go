@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"fmt"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+// qualityFormats are the output formats with a quality setting
+var qualityFormats = map[string]bool{"webp": true, "jpeg": true, "avif": true, "jxl": true, "png-palette": true}
+
+var autoQualityTargetSize, autoQualityTargetSizeErrors = parseSizeOption("BHP_AUTO_QUALITY_TARGET_SIZE", BHP_AUTO_QUALITY_TARGET_SIZE)
+
+func autoQualityErrors() []error {
+	errs := append([]error{}, autoQualityTargetSizeErrors...)
+	if BHP_AUTO_QUALITY_MIN < 1 || BHP_AUTO_QUALITY_MIN > 100 {
+		errs = append(errs, fmt.Errorf("BHP_AUTO_QUALITY_MIN: must be between 1 and 100, got %d", BHP_AUTO_QUALITY_MIN))
+	}
+	if BHP_AUTO_QUALITY_TARGET_PERCENT < 1 || BHP_AUTO_QUALITY_TARGET_PERCENT > 100 {
+		errs = append(errs, fmt.Errorf("BHP_AUTO_QUALITY_TARGET_PERCENT: must be between 1 and 100, got %d", BHP_AUTO_QUALITY_TARGET_PERCENT))
+	}
+	return errs
+}
+
+// qualityTargetSize returns the largest output accepted by the quality search: smaller
+// than the original, within BHP_AUTO_QUALITY_TARGET_PERCENT of it and BHP_AUTO_QUALITY_TARGET_SIZE
+func qualityTargetSize(originalImageSize int) int {
+	target := originalImageSize - 1
+	if BHP_AUTO_QUALITY_TARGET_PERCENT < 100 {
+		target = min(target, originalImageSize*BHP_AUTO_QUALITY_TARGET_PERCENT/100)
+	}
+	if autoQualityTargetSize > 0 {
+		target = min(target, int(autoQualityTargetSize))
+	}
+	return target
+}
+
+// CompressImageWithQualitySearch decodes the image once and searches the highest
+// quality whose output fits the target size, see searchQuality
+func CompressImageWithQualitySearch(imageBytes []byte, options CompressImageWithQualitySearchOptions) (*CompressImageResult, int, error) {
+	vipsImage, err := loadImage(imageBytes, CompressImageOptions{
+		InputFormat: options.InputFormat,
+		IsAnimated:  options.IsAnimated,
+		Format:      options.Format,
+		Grayscale:   options.Grayscale,
+		Resize:      options.Resize,
+	})
+	if err != nil {
+		return nil, options.InitialQuality, fmt.Errorf("failed to compress image: %w", err)
+	}
+	defer vipsImage.Close()
+
+	targetSize := qualityTargetSize(options.OriginalImageSize)
+	compressedImage, err := searchQuality(imageEncoder(vipsImage, options.Format), options.Format, options.InitialQuality, targetSize)
+	if err != nil {
+		return nil, options.InitialQuality, fmt.Errorf("failed to compress image: %w", err)
+	}
+	if compressedImage == nil {
+		return nil, min(BHP_AUTO_QUALITY_MIN, options.InitialQuality), fmt.Errorf("could not compress image into %s or less", FormatSize(int64(targetSize)))
+	}
+	return compressedImage, compressedImage.Quality, nil
+}
+
+// qualityEncoder encodes the same decoded image at the given quality
+type qualityEncoder func(quality int) ([]byte, error)
+
+// imageEncoder encodes the decoded image to the format
+func imageEncoder(vipsImage *vips.Image, format string) qualityEncoder {
+	return func(quality int) ([]byte, error) {
+		return encodeImage(vipsImage, format, quality)
+	}
+}
+
+// searchQuality binary searches the highest quality, from BHP_AUTO_QUALITY_MIN up to
+// the initial quality, whose output fits the target size. Each attempt encodes the
+// same decoded image. The result is nil when no quality fits.
+func searchQuality(encode qualityEncoder, format string, initialQuality int, targetSize int) (*CompressImageResult, error) {
+	low, high := min(BHP_AUTO_QUALITY_MIN, initialQuality), initialQuality
+	if !qualityFormats[format] {
+		low = high // Nothing to search
+	}
+
+	var best *CompressImageResult
+	quality := high // The initial quality is tried first, as it usually fits
+	for low <= high {
+		compressedImageBytes, err := encode(quality)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(compressedImageBytes) <= targetSize {
+			best = newCompressImageResult(compressedImageBytes, format, quality)
+			low = quality + 1
+		} else {
+			high = quality - 1
+		}
+		quality = (low + high + 1) / 2
+	}
+	return best, nil
+}
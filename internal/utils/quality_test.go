@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestQualityTargetSize(t *testing.T) {
+	previousPercent, previousSize := BHP_AUTO_QUALITY_TARGET_PERCENT, autoQualityTargetSize
+	t.Cleanup(func() { BHP_AUTO_QUALITY_TARGET_PERCENT, autoQualityTargetSize = previousPercent, previousSize })
+
+	tests := []struct {
+		name              string
+		percent           int
+		targetSize        int64
+		originalImageSize int
+		want              int
+	}{
+		{name: "smaller than the original", percent: 100, originalImageSize: 1000, want: 999},
+		{name: "percent of the original", percent: 50, originalImageSize: 1000, want: 500},
+		{name: "size limit", percent: 100, targetSize: 300, originalImageSize: 1000, want: 300},
+		{name: "size limit above the percent", percent: 50, targetSize: 800, originalImageSize: 1000, want: 500},
+		{name: "percent above the size limit", percent: 50, targetSize: 200, originalImageSize: 1000, want: 200},
+		{name: "size limit above the original", percent: 100, targetSize: 5000, originalImageSize: 1000, want: 999},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			BHP_AUTO_QUALITY_TARGET_PERCENT, autoQualityTargetSize = test.percent, test.targetSize
+			if got := qualityTargetSize(test.originalImageSize); got != test.want {
+				t.Errorf("qualityTargetSize(%d) = %d, want %d", test.originalImageSize, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSearchQuality(t *testing.T) {
+	previousMin := BHP_AUTO_QUALITY_MIN
+	t.Cleanup(func() { BHP_AUTO_QUALITY_MIN = previousMin })
+	BHP_AUTO_QUALITY_MIN = 10
+
+	tests := []struct {
+		name           string
+		format         string
+		initialQuality int
+		targetSize     int
+		wantQuality    int // -1 when no quality fits
+		wantFormat     string
+		wantAttempts   []int
+	}{
+		{name: "initial quality fits", format: "webp", initialQuality: 80, targetSize: 8000, wantQuality: 80, wantFormat: "webp", wantAttempts: []int{80}},
+		{name: "highest quality that fits", format: "jpeg", initialQuality: 80, targetSize: 5050, wantQuality: 50, wantFormat: "jpeg", wantAttempts: []int{80, 45, 63, 54, 50, 52, 51}},
+		{name: "minimum quality fits", format: "avif", initialQuality: 80, targetSize: 1000, wantQuality: 10, wantFormat: "avif", wantAttempts: []int{80, 45, 27, 18, 14, 12, 11, 10}},
+		{name: "nothing fits", format: "webp", initialQuality: 80, targetSize: 999, wantQuality: -1, wantAttempts: []int{80, 45, 27, 18, 14, 12, 11, 10}},
+		{name: "initial quality below the minimum", format: "webp", initialQuality: 5, targetSize: 499, wantQuality: -1, wantAttempts: []int{5}},
+		{name: "encoder variant", format: "png-palette", initialQuality: 80, targetSize: 4000, wantQuality: 40, wantFormat: "png", wantAttempts: []int{80, 45, 27, 36, 41, 39, 40}},
+		{name: "format without quality fits", format: "png", initialQuality: 80, targetSize: 8000, wantQuality: 0, wantFormat: "png", wantAttempts: []int{80}},
+		{name: "format without quality does not fit", format: "png", initialQuality: 80, targetSize: 7999, wantQuality: -1, wantAttempts: []int{80}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts []int
+			encode := func(quality int) ([]byte, error) {
+				attempts = append(attempts, quality)
+				return make([]byte, quality*100), nil // The output grows with the quality
+			}
+
+			result, err := searchQuality(encode, test.format, test.initialQuality, test.targetSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(attempts, test.wantAttempts) {
+				t.Errorf("searchQuality() tried %v, want %v", attempts, test.wantAttempts)
+			}
+			if test.wantQuality < 0 {
+				if result != nil {
+					t.Errorf("searchQuality() = quality %d, want no result", result.Quality)
+				}
+				return
+			}
+			if result == nil {
+				t.Fatalf("searchQuality() = nil, want quality %d", test.wantQuality)
+			}
+			if result.Quality != test.wantQuality || result.Format != test.wantFormat || len(result.Bytes) > test.targetSize {
+				t.Errorf("searchQuality() = %s quality %d of %d bytes, want %s quality %d", result.Format, result.Quality, len(result.Bytes), test.wantFormat, test.wantQuality)
+			}
+		})
+	}
+
+	t.Run("encoder error", func(t *testing.T) {
+		encoderError := errors.New("encoder failed")
+		encode := func(quality int) ([]byte, error) { return nil, encoderError }
+		if _, err := searchQuality(encode, "webp", 80, 1000); !errors.Is(err, encoderError) {
+			t.Errorf("searchQuality() error = %v, want %v", err, encoderError)
+		}
+	})
+}
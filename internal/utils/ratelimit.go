@@ -0,0 +1,272 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+type quotaUsage struct {
+	Day   string `json:"day"` // UTC date the bytes were fetched on
+	Bytes int64  `json:"bytes"`
+}
+
+var (
+	rateLimitMu     sync.Mutex
+	tokenBuckets    = map[string]*tokenBucket{}
+	quotaUsages     = map[string]*quotaUsage{}
+	quotaDirty      bool
+	bucketSweepTick int
+)
+
+func parseDailyQuota(quota string) (int64, []error) {
+	if quota == "" {
+		return 0, nil
+	}
+	size, err := ParseSize(quota)
+	if err != nil || size < 0 {
+		return 0, []error{fmt.Errorf("BHP_DAILY_UPSTREAM_QUOTA: invalid size %q", quota)}
+	}
+	return size, nil
+}
+
+var dailyQuota, dailyQuotaErrors = parseDailyQuota(BHP_DAILY_UPSTREAM_QUOTA)
+
+// clientKey identifies a client for rate limits and quotas
+func clientKey(client *Client) string {
+	return client.Method + ":" + client.Name
+}
+
+func rateLimitBurst() float64 {
+	if BHP_RATE_LIMIT_BURST > 0 {
+		return float64(BHP_RATE_LIMIT_BURST)
+	}
+	return math.Max(1, float64(BHP_RATE_LIMIT_PER_MINUTE)/6) // 10 seconds worth of requests
+}
+
+// takeToken consumes a token of the client's bucket, returning how long to
+// wait for the next one when the bucket is empty
+func takeToken(key string, now time.Time) (bool, time.Duration) {
+	if BHP_RATE_LIMIT_PER_MINUTE <= 0 {
+		return true, 0
+	}
+
+	ratePerSecond := float64(BHP_RATE_LIMIT_PER_MINUTE) / 60
+	burst := rateLimitBurst()
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	// Drop buckets that have been full for a while, so the map does not grow forever
+	bucketSweepTick++
+	if bucketSweepTick%1000 == 0 {
+		for k, bucket := range tokenBuckets {
+			if bucket.Tokens+now.Sub(bucket.Updated).Seconds()*ratePerSecond >= burst {
+				delete(tokenBuckets, k)
+			}
+		}
+	}
+
+	bucket, exists := tokenBuckets[key]
+	if !exists {
+		bucket = &tokenBucket{Tokens: burst, Updated: now}
+		tokenBuckets[key] = bucket
+	}
+
+	bucket.Tokens = math.Min(burst, bucket.Tokens+now.Sub(bucket.Updated).Seconds()*ratePerSecond)
+	bucket.Updated = now
+
+	if bucket.Tokens < 1 {
+		wait := time.Duration((1 - bucket.Tokens) / ratePerSecond * float64(time.Second))
+		return false, wait
+	}
+
+	bucket.Tokens--
+	return true, 0
+}
+
+func utcDay(now time.Time) string {
+	return now.UTC().Format(time.DateOnly)
+}
+
+func untilNextUtcDay(now time.Time) time.Duration {
+	utcNow := now.UTC()
+	nextDay := time.Date(utcNow.Year(), utcNow.Month(), utcNow.Day()+1, 0, 0, 0, 0, time.UTC)
+	return nextDay.Sub(utcNow)
+}
+
+// quotaExceeded reports whether the client already fetched its daily upstream quota
+func quotaExceeded(key string, now time.Time) bool {
+	if dailyQuota <= 0 {
+		return false
+	}
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	usage, exists := quotaUsages[key]
+	return exists && usage.Day == utcDay(now) && usage.Bytes >= dailyQuota
+}
+
+// RecordUpstreamBytes adds bytes fetched from the origin to the client's daily usage
+func RecordUpstreamBytes(r *http.Request, bytes int) {
+	if dailyQuota <= 0 {
+		return
+	}
+
+	key := clientKey(ClientFromRequest(r))
+	today := utcDay(time.Now())
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+
+	usage, exists := quotaUsages[key]
+	if !exists || usage.Day != today {
+		usage = &quotaUsage{Day: today}
+		quotaUsages[key] = usage
+	}
+	usage.Bytes += int64(bytes)
+	quotaDirty = true
+}
+
+func writeRetryAfter(w http.ResponseWriter, wait time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, message, http.StatusTooManyRequests)
+}
+
+// RateLimitMiddleware limits the request rate (BHP_RATE_LIMIT_PER_MINUTE) and
+// the daily upstream bytes (BHP_DAILY_UPSTREAM_QUOTA) of every client, identified
+// by its user name, API key name or IP address
+func RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/favicon.ico" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := ClientFromRequest(r)
+		key := clientKey(client)
+		now := time.Now()
+
+		if allowed, wait := takeToken(key, now); !allowed {
+			writeRetryAfter(w, wait, "Rate limit exceeded")
+			RecordFailure("Rate limit exceeded", "Rejecting request")
+			log.Printf("\n> Request: %s\n> Info:\n > Error: Rate limit exceeded for %s\n > Action: Rejecting request\n", r.URL.Path, key)
+			return
+		}
+
+		if quotaExceeded(key, now) {
+			writeRetryAfter(w, untilNextUtcDay(now), "Daily upstream quota exceeded")
+			RecordFailure("Daily upstream quota exceeded", "Rejecting request")
+			log.Printf("\n> Request: %s\n> Info:\n > Error: Daily upstream quota exceeded for %s\n > Action: Rejecting request\n", r.URL.Path, key)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LoadQuotaState restores the daily usage counters from BHP_QUOTA_STATE_FILE
+func LoadQuotaState() error {
+	if BHP_QUOTA_STATE_FILE == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(BHP_QUOTA_STATE_FILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read quota state: %v", err)
+	}
+
+	usages := map[string]*quotaUsage{}
+	if err := json.Unmarshal(content, &usages); err != nil {
+		return fmt.Errorf("failed to parse quota state: %v", err)
+	}
+
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	quotaUsages = usages
+	return nil
+}
+
+// SaveQuotaState writes the daily usage counters of today to BHP_QUOTA_STATE_FILE
+func SaveQuotaState() error {
+	if BHP_QUOTA_STATE_FILE == "" {
+		return nil
+	}
+
+	rateLimitMu.Lock()
+	today := utcDay(time.Now())
+	usages := make(map[string]*quotaUsage, len(quotaUsages))
+	for key, usage := range quotaUsages {
+		if usage.Day == today {
+			usages[key] = &quotaUsage{Day: usage.Day, Bytes: usage.Bytes}
+		}
+	}
+	quotaDirty = false
+	rateLimitMu.Unlock()
+
+	content, err := json.MarshalIndent(usages, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quota state: %v", err)
+	}
+
+	// Write to a temporary file first, so a crash cannot leave a truncated state
+	tempFile := BHP_QUOTA_STATE_FILE + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(BHP_QUOTA_STATE_FILE), 0o755); err != nil {
+		return fmt.Errorf("failed to save quota state: %v", err)
+	}
+	if err := os.WriteFile(tempFile, content, 0o644); err != nil {
+		return fmt.Errorf("failed to save quota state: %v", err)
+	}
+	if err := os.Rename(tempFile, BHP_QUOTA_STATE_FILE); err != nil {
+		return fmt.Errorf("failed to save quota state: %v", err)
+	}
+	return nil
+}
+
+// PersistQuotaState saves the usage counters every minute while they change,
+// and once more when ctx is done
+func PersistQuotaState(ctx context.Context) {
+	if BHP_QUOTA_STATE_FILE == "" {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rateLimitMu.Lock()
+			dirty := quotaDirty
+			rateLimitMu.Unlock()
+
+			if dirty {
+				if err := SaveQuotaState(); err != nil {
+					log.Println("Error:", err)
+				}
+			}
+		case <-ctx.Done():
+			if err := SaveQuotaState(); err != nil {
+				log.Println("Error:", err)
+			}
+			return
+		}
+	}
+}
@@ -1,16 +1,29 @@
 package utils
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+)
 
-func compileOmittedHeaders(omitHeaders []string) []*regexp.Regexp {
-	compiled := make([]*regexp.Regexp, len(omitHeaders))
-	for i, value := range omitHeaders {
-		compiled[i] = regexp.MustCompile("(?i)" + value)
+// compileHeaderPatterns compiles every valid pattern of the option and returns the
+// invalid ones as errors instead of panicking, so they can be reported by ValidateConfig.
+func compileHeaderPatterns(option string, patterns []string) ([]*regexp.Regexp, []error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	var errs []error
+	for _, value := range patterns {
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid pattern %q: %v", option, value, err))
+			continue
+		}
+		compiled = append(compiled, re)
 	}
-	return compiled
+	return compiled, errs
 }
 
 var (
-	inputUrlRegex         = regexp.MustCompile(`(?i)^http://1\.1\.\d+\.\d+/bmi/(https?://)?`)
-	omittedHeadersRegexes = compileOmittedHeaders(BHP_EXTERNAL_REQUEST_OMIT_HEADERS)
+	inputUrlRegex                                        = regexp.MustCompile(`(?i)^http://1\.1\.\d+\.\d+/bmi/(https?://)?`)
+	omittedHeadersRegexes, omittedHeadersErrors          = compileHeaderPatterns("BHP_EXTERNAL_REQUEST_OMIT_HEADERS", BHP_EXTERNAL_REQUEST_OMIT_HEADERS)
+	allowedResponseHeaders, allowedResponseHeadersErrors = compileHeaderPatterns("BHP_RESPONSE_HEADERS_ALLOW", BHP_RESPONSE_HEADERS_ALLOW)
+	deniedResponseHeaders, deniedResponseHeadersErrors   = compileHeaderPatterns("BHP_RESPONSE_HEADERS_DENY", BHP_RESPONSE_HEADERS_DENY)
 )
@@ -1,6 +1,9 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,12 +18,29 @@ var (
 	skipHeadersMap = map[string]bool{
 		"host":            true,
 		"accept-encoding": true,
+		// Conditional and range headers of the client refer to the compressed
+		// image, not to the original
+		"if-none-match":       true,
+		"if-modified-since":   true,
+		"if-match":            true,
+		"if-unmodified-since": true,
+		"if-range":            true,
+		"range":               true,
 	}
 )
 
 func RequestImage(url string, headers http.Header) (*ImageResponse, error) {
+	return RequestImageConditional(url, headers, UpstreamValidators{})
+}
+
+// RequestImageConditional fetches the image unless it still matches validators,
+// in which case the response has NotModified set and no bytes
+func RequestImageConditional(url string, headers http.Header, validators UpstreamValidators) (*ImageResponse, error) {
 	requestHeaders := map[string]string{}
 
+	headers = headers.Clone()
+	removeHopByHopHeaders(headers)
+
 reqHeaderLoop:
 	for headerKey, headerValue := range headers {
 		headerKeyLower := strings.ToLower(headerKey)
@@ -35,12 +55,19 @@ reqHeaderLoop:
 			}
 		}
 
-		requestHeaders[headerKeyLower] = headerValue[0]
+		requestHeaders[headerKeyLower] = joinHeaderValues(headerKey, headerValue)
 	}
 
 	// Set Accept-Encoding header to handle all compression types we support
 	requestHeaders["accept-encoding"] = "br, zstd, gzip, deflate, lz4, xz, identity"
 
+	if validators.ETag != "" {
+		requestHeaders["if-none-match"] = validators.ETag
+	}
+	if validators.LastModified != "" {
+		requestHeaders["if-modified-since"] = validators.LastModified
+	}
+
 	duration, err := time.ParseDuration(BHP_EXTERNAL_REQUEST_TIMEOUT)
 	if err != nil {
 		return nil, fmt.Errorf("invalid timeout duration: %v", err)
@@ -67,8 +94,10 @@ reqHeaderLoop:
 	// If a FlareSolverr instance is configured, use it to solve any
 	// anti-bot/Cloudflare challenge for this host and reuse the resulting
 	// cookies + User-Agent for the actual fetch below.
+	usingCachedSolution := false
 	if strings.TrimSpace(BHP_FLARESOLVERR_URL) != "" {
-		solution, err := SolveWithFlareSolverr(url, duration)
+		solution, cached, err := flareSolverrSolutionFor(url, duration)
+		usingCachedSolution = cached
 		if err != nil {
 			return nil, fmt.Errorf("flaresolverr failed to solve challenge for %s: %v", url, err)
 		}
@@ -87,7 +116,8 @@ reqHeaderLoop:
 	}
 
 	var resp *http.Response
-	var data []byte
+	var buffer *bytes.Buffer
+	var wire *countingReader // Counts the bytes of the origin response as received
 	var lastErr error
 
 	for attempt := 0; attempt < BHP_EXTERNAL_REQUEST_RETRIES+1; attempt++ {
@@ -107,6 +137,17 @@ reqHeaderLoop:
 			continue
 		}
 
+		if resp.StatusCode == http.StatusNotModified && (validators.ETag != "" || validators.LastModified != "") {
+			resp.Body.Close()
+			return &ImageResponse{
+				Bytes:           []byte{},
+				RequestHeaders:  requestHeaders,
+				ResponseHeaders: resp.Header,
+				Proto:           resp.Proto,
+				NotModified:     true,
+			}, nil
+		}
+
 		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 			statusCode := resp.StatusCode // Save status code before closing
 			resp.Body.Close()
@@ -114,19 +155,37 @@ reqHeaderLoop:
 			lastErr = fmt.Errorf("failed to fetch image: status %d", statusCode)
 			continue
 		}
-		defer resp.Body.Close()
 
-		respBody, err := io.ReadAll(resp.Body)
+		wire = &countingReader{ReadCloser: resp.Body}
+		resp.Body = wire
+		body, sniffer, err := decodedBody(resp)
 		if err != nil {
+			resp.Body.Close()
 			lastErr = err
 			continue
 		}
 
-		// Decompress response data based on Content-Encoding header or magic bytes
-		contentEncoding := resp.Header.Get("Content-Encoding")
-		data, err = DecompressResponse(respBody, contentEncoding)
+		// Non-image responses are handed over unread, so they can be streamed to the client
+		head, _ := sniffer.Peek(sniffLength)
+		if !looksLikeImage(resp.Header.Get("Content-Type"), head) {
+			return &ImageResponse{
+				RequestHeaders:  requestHeaders,
+				ResponseHeaders: resp.Header,
+				Proto:           resp.Proto,
+				StatusCode:      resp.StatusCode,
+				Body:            &streamedBody{Reader: sniffer, closers: []io.Closer{body, resp.Body}},
+				wire:            wire,
+			}, nil
+		}
+
+		buffer, err = readImageBody(sniffer, resp.ContentLength)
+		body.Close()
+		resp.Body.Close()
+		if errors.Is(err, ErrImageTooLarge) {
+			return nil, err // Fetching it again would not help
+		}
 		if err != nil {
-			lastErr = fmt.Errorf("failed to decompress response data (encoding: %s): %v", contentEncoding, err)
+			lastErr = err
 			continue
 		}
 
@@ -136,17 +195,173 @@ reqHeaderLoop:
 	}
 
 	if lastErr != nil {
+		// The cached cookies may have expired, solve the challenge again next time
+		if usingCachedSolution {
+			ClearFlareSolverrSessions(imageDomain(url))
+		}
 		return nil, lastErr
 	}
 	// Additional safety check - ensure we have valid response data
-	if resp == nil || data == nil {
+	if resp == nil || buffer == nil {
 		return nil, fmt.Errorf("no valid response received after %d attempts", BHP_EXTERNAL_REQUEST_RETRIES+1)
 	}
 
 	imageResponse := &ImageResponse{
-		Bytes:           data,
+		Bytes:           buffer.Bytes(),
 		RequestHeaders:  requestHeaders,
 		ResponseHeaders: resp.Header,
+		Proto:           resp.Proto,
+		StatusCode:      resp.StatusCode,
+		buffer:          buffer,
+		wire:            wire,
 	}
 	return imageResponse, nil
 }
+
+// sniffLength is how much of the body is read to tell images from other content
+const sniffLength = 4096
+
+// maxPooledBufferSize keeps the buffers of unusually large images out of the pool
+const maxPooledBufferSize = 16 << 20
+
+// ErrImageTooLarge is returned for images larger than BHP_MAX_IMAGE_SIZE
+var ErrImageTooLarge = errors.New("image exceeds BHP_MAX_IMAGE_SIZE")
+
+// imageBuffers hold the upstream images, reused so that each request only
+// allocates when its image is larger than the ones before
+var imageBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+var maxImageSize, maxImageSizeErrors = parseSizeOption("BHP_MAX_IMAGE_SIZE", BHP_MAX_IMAGE_SIZE)
+
+// decodedBody returns the body decompressed on the fly, behind a reader that
+// can peek at its start. Bodies without a Content-Encoding header are
+// decompressed when their magic bytes show they are compressed, whatever their
+// declared type, as long as the decompressed start is an image or the body is
+// declared as one. Other compressed content, e.g. archives, is left as it is.
+func decodedBody(resp *http.Response) (io.ReadCloser, *bufio.Reader, error) {
+	contentEncoding := resp.Header.Get("Content-Encoding")
+	body, err := NewDecompressReader(resp.Body, contentEncoding)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress response data (encoding: %s): %v", contentEncoding, err)
+	}
+	sniffer := bufio.NewReaderSize(body, sniffLength)
+	if contentEncoding != "" {
+		return body, sniffer, nil
+	}
+
+	head, _ := sniffer.Peek(sniffLength)
+	contentEncoding = encodingByMagicBytes(head)
+	if contentEncoding == "" || !compressedImage(resp.Header.Get("Content-Type"), head, contentEncoding) {
+		return body, sniffer, nil
+	}
+	decoded, err := NewDecompressReader(sniffer, contentEncoding)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decompress response data (detected encoding: %s): %v", contentEncoding, err)
+	}
+	return decoded, bufio.NewReaderSize(decoded, sniffLength), nil
+}
+
+// compressedImage reports whether the compressed start of a body decompresses
+// to an image, or the body is declared as an image
+func compressedImage(contentType string, head []byte, contentEncoding string) bool {
+	if strings.HasPrefix(mediaType(contentType), "image/") {
+		return true
+	}
+
+	decoder, err := NewDecompressReader(bytes.NewReader(head), contentEncoding)
+	if err != nil {
+		return false
+	}
+	defer decoder.Close()
+	decodedHead := make([]byte, sniffLength)
+	n, _ := io.ReadFull(decoder, decodedHead)
+	return DetectImageFormat(decodedHead[:n]) != ""
+}
+
+// looksLikeImage reports whether the start of the body is an image vips can
+// load. Unrecognized content declared as an image is still given to vips.
+func looksLikeImage(contentType string, head []byte) bool {
+	if len(head) == 0 {
+		return false
+	}
+	return DetectImageFormat(head) != "" || strings.HasPrefix(mediaType(contentType), "image/")
+}
+
+// readImageBody reads the decoded image into a pooled buffer, sized from the
+// Content-Length so it is usually allocated once, and stops at BHP_MAX_IMAGE_SIZE
+func readImageBody(body io.Reader, sizeHint int64) (*bytes.Buffer, error) {
+	if maxImageSize > 0 && sizeHint > maxImageSize {
+		return nil, ErrImageTooLarge
+	}
+
+	buffer := imageBuffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	if sizeHint > 0 {
+		// The Content-Length comes from the origin, so it is trusted only up to the
+		// size of pooled buffers. ReadFrom grows the buffer for larger bodies as
+		// their bytes arrive, and when less than MinRead is free.
+		buffer.Grow(int(min(sizeHint, maxPooledBufferSize)) + bytes.MinRead)
+	}
+
+	if maxImageSize > 0 {
+		body = io.LimitReader(body, maxImageSize+1)
+	}
+	_, err := buffer.ReadFrom(body)
+	if err == nil && maxImageSize > 0 && int64(buffer.Len()) > maxImageSize {
+		err = ErrImageTooLarge
+	}
+	if err != nil {
+		releaseImageBuffer(buffer)
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func releaseImageBuffer(buffer *bytes.Buffer) {
+	if buffer.Cap() <= maxPooledBufferSize {
+		imageBuffers.Put(buffer)
+	}
+}
+
+// Release returns the image buffer to the pool, Bytes must not be used afterwards
+func (imageResponse *ImageResponse) Release() {
+	if imageResponse.buffer != nil {
+		releaseImageBuffer(imageResponse.buffer)
+		imageResponse.buffer = nil
+		imageResponse.Bytes = nil
+	}
+}
+
+// UpstreamBytes returns how many bytes of the origin response were received so
+// far, as sent on the wire before they are decoded
+func (imageResponse *ImageResponse) UpstreamBytes() int {
+	if imageResponse.wire == nil {
+		return 0
+	}
+	return int(imageResponse.wire.count)
+}
+
+// countingReader counts the bytes read from the origin response body
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (reader *countingReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	reader.count += int64(n)
+	return n, err
+}
+
+// streamedBody closes the decoders and the origin response along with the body
+type streamedBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (body *streamedBody) Close() error {
+	for _, closer := range body.closers {
+		closer.Close()
+	}
+	return nil
+}
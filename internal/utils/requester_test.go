@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"image"
+	"image/png"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func gzipped(t testing.TB, data []byte) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDecodedBody(t *testing.T) {
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+	text := []byte("<!DOCTYPE html><html><body>Not found</body></html>")
+
+	tests := []struct {
+		name            string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		want            []byte
+	}{
+		{name: "image", contentType: "image/gif", body: gif, want: gif},
+		{name: "declared encoding", contentType: "image/gif", contentEncoding: "gzip", body: gzipped(t, gif), want: gif},
+		{name: "compressed image", contentType: "image/gif", body: gzipped(t, gif), want: gif},
+		{name: "compressed image declared as binary", contentType: "application/octet-stream", body: gzipped(t, gif), want: gif},
+		{name: "compressed image without a type", body: gzipped(t, gif), want: gif},
+		{name: "compressed unrecognized content declared as an image", contentType: "image/x-unknown", body: gzipped(t, text), want: text},
+		{name: "compressed archive", contentType: "application/gzip", body: gzipped(t, text), want: gzipped(t, text)},
+		{name: "text", contentType: "text/html", body: text, want: text},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(test.body))}
+			if test.contentType != "" {
+				resp.Header.Set("Content-Type", test.contentType)
+			}
+			if test.contentEncoding != "" {
+				resp.Header.Set("Content-Encoding", test.contentEncoding)
+			}
+
+			body, sniffer, err := decodedBody(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			got, err := io.ReadAll(sniffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("decodedBody() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestImageUpstreamBytes(t *testing.T) {
+	gif := append([]byte("GIF89a\x01\x00\x01\x00\x00\x00\x00"), make([]byte, 4096)...)
+	text := bytes.Repeat([]byte("Not found. "), 1000)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{name: "image", contentType: "image/gif", body: gif},
+		{name: "non-image", contentType: "text/plain", body: text},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			compressedBody := gzipped(t, test.body)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write(compressedBody)
+			}))
+			defer server.Close()
+
+			imageResponse, err := RequestImage(server.URL, http.Header{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer imageResponse.Release()
+			if imageResponse.Body != nil {
+				if _, err := io.Copy(io.Discard, imageResponse.Body); err != nil {
+					t.Fatal(err)
+				}
+				imageResponse.Body.Close()
+			}
+			if got := imageResponse.UpstreamBytes(); got != len(compressedBody) {
+				t.Errorf("UpstreamBytes() = %d, want the %d compressed bytes", got, len(compressedBody))
+			}
+		})
+	}
+}
+
+func TestReadImageBodyUntrustedSize(t *testing.T) {
+	previousMaxImageSize := maxImageSize
+	t.Cleanup(func() { maxImageSize = previousMaxImageSize })
+
+	for _, limit := range []int64{0, 100 << 20} {
+		maxImageSize = limit
+		buffer, err := readImageBody(bytes.NewReader([]byte("GIF89a")), 90<<20)
+		if err != nil {
+			t.Fatalf("readImageBody() with BHP_MAX_IMAGE_SIZE %d error: %v", limit, err)
+		}
+		// Allocation size classes round the buffer up a little
+		if buffer.String() != "GIF89a" || buffer.Cap() > 2*maxPooledBufferSize {
+			t.Errorf("readImageBody() with BHP_MAX_IMAGE_SIZE %d = %q in a buffer of %d bytes, want about %d at most", limit, buffer.String(), buffer.Cap(), maxPooledBufferSize)
+		}
+		releaseImageBuffer(buffer)
+	}
+}
+
+// noisePng returns a PNG of random pixels, which PNG cannot compress, of about size bytes
+func noisePng(b *testing.B, size int) []byte {
+	side := 1
+	for side*side*4 < size {
+		side++
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, side, side))
+	random := rand.New(rand.NewPCG(1, 2))
+	for i := range img.Pix {
+		img.Pix[i] = byte(random.Uint32())
+	}
+
+	var buffer bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestSpeed}).Encode(&buffer, img); err != nil {
+		b.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// readAllImage is the former RequestImage path, reading the whole body before decompressing it in memory
+func readAllImage(client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil || resp.Header.Get("Content-Encoding") != "gzip" {
+		return data, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func BenchmarkRequestImage(b *testing.B) {
+	image := noisePng(b, 4<<20)
+	bodies := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+	}{
+		{name: "identity", body: image},
+		{name: "gzip", contentEncoding: "gzip", body: gzipped(b, image)},
+	}
+
+	for _, body := range bodies {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			if body.contentEncoding != "" {
+				w.Header().Set("Content-Encoding", body.contentEncoding)
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(body.body)))
+			w.Write(body.body)
+		}))
+		defer server.Close()
+
+		b.Run(body.name+"/streamed", func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(image)))
+			for b.Loop() {
+				imageResponse, err := RequestImage(server.URL, http.Header{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(imageResponse.Bytes) != len(image) {
+					b.Fatalf("RequestImage() read %d bytes, want %d", len(imageResponse.Bytes), len(image))
+				}
+				imageResponse.Release()
+			}
+		})
+
+		b.Run(body.name+"/read-all", func(b *testing.B) {
+			client := server.Client()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(image)))
+			for b.Loop() {
+				data, err := readAllImage(client, server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(data) != len(image) {
+					b.Fatalf("readAllImage() read %d bytes, want %d", len(data), len(image))
+				}
+			}
+		})
+	}
+}
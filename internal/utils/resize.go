@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+// maxDimension is used for an unconstrained side, it matches VIPS_MAX_COORD
+const maxDimension = 10000000
+
+var ResizeTypes = map[string]bool{
+	"fit":       true,
+	"fill":      true,
+	"fill-down": true,
+	"force":     true,
+	"auto":      true,
+}
+
+var Gravities = map[string]bool{
+	"ce":   true,
+	"no":   true,
+	"so":   true,
+	"ea":   true,
+	"we":   true,
+	"noea": true,
+	"nowe": true,
+	"soea": true,
+	"sowe": true,
+	"sm":   true,
+}
+
+func (options ResizeOptions) IsSet() bool {
+	return options.Width > 0 || options.Height > 0
+}
+
+// ResizeImage resizes the image in place according to the resize options.
+// Multi-page (animated) images are left untouched, as the thumbnail
+// operation is not page-aware.
+func ResizeImage(vipsImage *vips.Image, options ResizeOptions) error {
+	if !options.IsSet() || vipsImage.Pages() > 1 {
+		return nil
+	}
+
+	imageWidth, imageHeight := vipsImage.Width(), vipsImage.Height()
+	if imageWidth == 0 || imageHeight == 0 {
+		return nil
+	}
+
+	resizeType := options.Type
+	if resizeType == "" {
+		resizeType = "fit"
+	}
+	if options.Width == 0 || options.Height == 0 {
+		resizeType = "fit" // Cropping and forcing need both sides
+	}
+	if resizeType == "auto" {
+		resizeType = "fit"
+		if (imageWidth >= imageHeight) == (options.Width >= options.Height) {
+			resizeType = "fill" // Same orientation
+		}
+	}
+
+	switch resizeType {
+	case "fit":
+		width, height := options.Width, options.Height
+		if width == 0 {
+			width = maxDimension
+		}
+		if height == 0 {
+			height = maxDimension
+		}
+		return thumbnail(vipsImage, width, height, options.Enlarge, vips.SizeBoth)
+	case "force":
+		return thumbnail(vipsImage, options.Width, options.Height, options.Enlarge, vips.SizeForce)
+	case "outside":
+		// Cover width x height while keeping the aspect ratio, without cropping
+		scale := math.Max(float64(options.Width)/float64(imageWidth), float64(options.Height)/float64(imageHeight))
+		if !options.Enlarge && scale > 1 {
+			return nil
+		}
+		return thumbnail(vipsImage, max(1, int(math.Round(float64(imageWidth)*scale))), maxDimension, true, vips.SizeBoth)
+	case "fill", "fill-down":
+		return fillImage(vipsImage, options, resizeType == "fill-down")
+	default:
+		return fmt.Errorf("unknown resizing type: %s", options.Type)
+	}
+}
+
+func thumbnail(vipsImage *vips.Image, width int, height int, enlarge bool, size vips.Size) error {
+	if !enlarge && size == vips.SizeBoth {
+		size = vips.SizeDown
+	}
+	if !enlarge && size == vips.SizeForce {
+		width = min(width, vipsImage.Width())
+		height = min(height, vipsImage.Height())
+	}
+
+	if err := vipsImage.ThumbnailImage(width, &vips.ThumbnailImageOptions{
+		Height: height,
+		Size:   size,
+		Crop:   vips.InterestingNone,
+	}); err != nil {
+		return fmt.Errorf("failed to resize image: %w", err)
+	}
+	return nil
+}
+
+// fillImage scales the image to cover width x height, then crops the
+// overflowing side based on the gravity
+func fillImage(vipsImage *vips.Image, options ResizeOptions, keepTargetRatio bool) error {
+	imageWidth, imageHeight := float64(vipsImage.Width()), float64(vipsImage.Height())
+	targetWidth, targetHeight := options.Width, options.Height
+
+	scale := math.Max(float64(targetWidth)/imageWidth, float64(targetHeight)/imageHeight)
+	if !options.Enlarge && scale > 1 {
+		scale = 1
+
+		// fill-down keeps the requested aspect ratio when the image is too small
+		if keepTargetRatio {
+			ratio := math.Min(imageWidth/float64(targetWidth), imageHeight/float64(targetHeight))
+			targetWidth = int(math.Round(float64(targetWidth) * ratio))
+			targetHeight = int(math.Round(float64(targetHeight) * ratio))
+		}
+	}
+
+	scaledWidth := max(1, int(math.Round(imageWidth*scale)))
+	scaledHeight := max(1, int(math.Round(imageHeight*scale)))
+	if scale != 1 {
+		if err := thumbnail(vipsImage, scaledWidth, scaledHeight, true, vips.SizeForce); err != nil {
+			return err
+		}
+	}
+
+	cropWidth := min(max(1, targetWidth), scaledWidth)
+	cropHeight := min(max(1, targetHeight), scaledHeight)
+	if cropWidth == scaledWidth && cropHeight == scaledHeight {
+		return nil
+	}
+
+	if options.Gravity == "sm" {
+		if err := vipsImage.Smartcrop(cropWidth, cropHeight, &vips.SmartcropOptions{
+			Interesting: vips.InterestingAttention,
+		}); err != nil {
+			return fmt.Errorf("failed to crop image: %w", err)
+		}
+		return nil
+	}
+
+	left, top := gravityOffset(options.Gravity, scaledWidth-cropWidth, scaledHeight-cropHeight)
+	if err := vipsImage.ExtractArea(left, top, cropWidth, cropHeight); err != nil {
+		return fmt.Errorf("failed to crop image: %w", err)
+	}
+	return nil
+}
+
+// gravityOffset returns the top-left corner of the crop area,
+// given the horizontal and vertical overflow
+func gravityOffset(gravity string, overflowX int, overflowY int) (int, int) {
+	left, top := overflowX/2, overflowY/2
+
+	switch gravity {
+	case "no", "noea", "nowe":
+		top = 0
+	case "so", "soea", "sowe":
+		top = overflowY
+	}
+
+	switch gravity {
+	case "we", "nowe", "sowe":
+		left = 0
+	case "ea", "noea", "soea":
+		left = overflowX
+	}
+
+	return left, top
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/pkg/urlsigning"
+)
+
+const minSigningKeyLength = 16
+
+func toSigningKeys(keys []string) [][]byte {
+	signingKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		signingKeys[i] = []byte(key)
+	}
+	return signingKeys
+}
+
+var urlSigningKeys = toSigningKeys(BHP_URL_SIGNING_KEYS)
+
+// VerifyUrlSignature rejects requests without a valid signature,
+// when URL signing is enabled with BHP_URL_SIGNING_KEYS
+func VerifyUrlSignature(r *http.Request) error {
+	if len(urlSigningKeys) == 0 {
+		return nil
+	}
+	return urlsigning.Verify(r.URL.Query(), urlSigningKeys, time.Now())
+}
+
+// UrlSigningKey returns the key new links are signed with
+func UrlSigningKey() []byte {
+	if len(urlSigningKeys) == 0 {
+		return nil
+	}
+	return urlSigningKeys[0]
+}
+
+func rejectUnsigned(w http.ResponseWriter, r *http.Request) bool {
+	err := VerifyUrlSignature(r)
+	if err == nil {
+		return false
+	}
+
+	forbidUnsigned(w, r, err)
+	return true
+}
+
+func forbidUnsigned(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+	RecordFailure("Invalid URL signature", "Rejecting unsigned request")
+	log.Printf("\n> Request: %s\n> Info:\n > Error: %s\n > Action: Rejecting unsigned request\n", r.URL.RequestURI(), err.Error())
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnsignedRequestsAreForbidden(t *testing.T) {
+	previousKeys, previousPrefix := urlSigningKeys, BHP_IMGPROXY_PATH_PREFIX
+	previousImgproxyKey, previousImgproxySalt := imgproxyKey, imgproxySalt
+	t.Cleanup(func() {
+		urlSigningKeys, BHP_IMGPROXY_PATH_PREFIX = previousKeys, previousPrefix
+		imgproxyKey, imgproxySalt = previousImgproxyKey, previousImgproxySalt
+	})
+	urlSigningKeys = toSigningKeys([]string{"0123456789abcdef"})
+	BHP_IMGPROXY_PATH_PREFIX = "/imgproxy"
+
+	// Routed like the serve command does
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /", ProxyHandler)
+	mux.HandleFunc("GET /weserv", WeservHandler)
+	handler := MountImgproxy(mux)
+
+	tests := []struct {
+		name        string
+		target      string
+		imgproxyKey []byte
+	}{
+		{name: "Bandwidth Hero API", target: "/?url=https://example.com/cat.jpg"},
+		{name: "Bandwidth Hero API with an invalid signature", target: "/?url=https://example.com/cat.jpg&sig=AAAA"},
+		{name: "weserv API", target: "/weserv?url=example.com/cat.jpg"},
+		{name: "imgproxy API without a key", target: "/imgproxy/insecure/plain/https://example.com/cat.jpg"},
+		{name: "imgproxy API with a signature in the query", target: "/imgproxy/insecure/plain/https://example.com/cat.jpg?sig=AAAA"},
+		{name: "imgproxy API with a key", target: "/imgproxy/insecure/plain/https://example.com/cat.jpg", imgproxyKey: []byte("key")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			imgproxyKey, imgproxySalt = test.imgproxyKey, test.imgproxyKey
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.target, nil))
+			if recorder.Code != http.StatusForbidden {
+				t.Errorf("GET %s = %d, want %d", test.target, recorder.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// imageSignature maps the magic bytes at the start of a file to its media type
+type imageSignature struct {
+	Magic     []byte
+	MediaType string
+}
+
+// imageSignatures are the fixed signatures of the formats vips can load, the
+// container formats (PNG, RIFF, ISO BMFF, SVG) are detected separately
+var imageSignatures = []imageSignature{
+	{[]byte("\xff\xd8\xff"), "image/jpeg"},
+	{[]byte("GIF87a"), "image/gif"},
+	{[]byte("GIF89a"), "image/gif"},
+	{[]byte("\xff\x0a"), "image/jxl"},
+	{[]byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"), "image/jxl"},
+	{[]byte("II*\x00"), "image/tiff"},
+	{[]byte("MM\x00*"), "image/tiff"},
+	{[]byte("%PDF-"), "application/pdf"},
+	{[]byte("\x00\x00\x00\x0cjP  \x0d\x0a\x87\x0a"), "image/jp2"},
+	{[]byte("\xff\x4f\xff\x51"), "image/jp2"},
+	{[]byte("\x00\x00\x01\x00"), "image/x-icon"},
+	{[]byte("\x76\x2f\x31\x01"), "image/x-exr"},
+	{[]byte("SIMPLE  ="), "image/fits"},
+	{[]byte("#?RADIANCE"), "image/vnd.radiance"},
+	{[]byte("#?RGBE"), "image/vnd.radiance"},
+}
+
+var (
+	avifBrands = map[string]bool{"avif": true, "avis": true}
+	heifBrands = map[string]bool{"heic": true, "heix": true, "hevc": true, "hevx": true, "heim": true, "heis": true, "mif1": true, "msf1": true}
+)
+
+// DetectImageFormat returns the media type of the image from its magic bytes,
+// or "" when it is not a format vips can load
+func DetectImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\x0d\x0a\x1a\x0a")):
+		if isAnimatedPng(data) {
+			return "image/apng"
+		}
+		return "image/png"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return "image/webp"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return isoMediaFormat(data)
+	case isPortableAnymap(data):
+		return "image/x-portable-anymap"
+	case isBmp(data):
+		return "image/bmp"
+	}
+
+	for _, signature := range imageSignatures {
+		if bytes.HasPrefix(data, signature.Magic) {
+			return signature.MediaType
+		}
+	}
+
+	if isSvg(data) {
+		return "image/svg+xml"
+	}
+	return ""
+}
+
+// isAnimatedPng looks for the animation control chunk, which APNG places before the image data
+func isAnimatedPng(data []byte) bool {
+	for offset := 8; offset+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		switch string(data[offset+4 : offset+8]) {
+		case "acTL":
+			return true
+		case "IDAT":
+			return false
+		}
+		if length < 0 || offset+12+length > len(data) {
+			return false
+		}
+		offset += 12 + length // Length, type, data and CRC
+	}
+	return false
+}
+
+// isoMediaFormat tells AVIF and HEIF apart by the brands of the ftyp box
+func isoMediaFormat(data []byte) string {
+	boxSize := int(binary.BigEndian.Uint32(data))
+	if boxSize < 16 || boxSize > len(data) {
+		boxSize = min(len(data), 64)
+	}
+
+	brands := []string{string(data[8:12])} // Major brand, then the compatible brands after the minor version
+	for offset := 16; offset+4 <= boxSize; offset += 4 {
+		brands = append(brands, string(data[offset:offset+4]))
+	}
+
+	for _, brand := range brands {
+		if avifBrands[brand] {
+			return "image/avif"
+		}
+	}
+	for _, brand := range brands {
+		if heifBrands[brand] {
+			return "image/heif"
+		}
+	}
+	return ""
+}
+
+// isPortableAnymap matches the PBM, PGM, PPM and PFM headers ("P1" to "P6", "Pf", "PF")
+func isPortableAnymap(data []byte) bool {
+	if len(data) < 3 || data[0] != 'P' || !strings.ContainsRune("123456fF", rune(data[1])) {
+		return false
+	}
+	return data[2] == ' ' || data[2] == '\t' || data[2] == '\n' || data[2] == '\r'
+}
+
+// isBmp matches "BM" followed by a known DIB header size, as "BM" alone is common in text
+func isBmp(data []byte) bool {
+	if len(data) < 18 || !bytes.HasPrefix(data, []byte("BM")) {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(data[14:]) {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// isSvg matches XML documents whose root element is svg: after an optional BOM, the
+// XML declaration, comments, processing instructions and the doctype, the first
+// element must be <svg. HTML pages with inline svg icons do not match.
+func isSvg(data []byte) bool {
+	head := bytes.TrimPrefix(data[:min(len(data), 4096)], []byte("\xef\xbb\xbf"))
+	for {
+		head = bytes.TrimLeft(head, " \t\r\n")
+		switch {
+		case bytes.HasPrefix(head, []byte("<?")):
+			head = skipPast(head, "?>")
+		case bytes.HasPrefix(head, []byte("<!--")):
+			head = skipPast(head, "-->")
+		case hasPrefixFold(head, "<!doctype"):
+			if !hasPrefixFold(bytes.TrimLeft(head[len("<!doctype"):], " \t\r\n"), "svg") {
+				return false
+			}
+			head = skipPast(head, ">") // SVG doctypes do not have an internal subset in practice
+		default:
+			return hasPrefixFold(head, "<svg") && len(head) > 4 && strings.ContainsRune(" \t\r\n>/", rune(head[4]))
+		}
+	}
+}
+
+// skipPast returns what follows the first end marker, nothing when there is none
+func skipPast(data []byte, end string) []byte {
+	_, rest, found := bytes.Cut(data, []byte(end))
+	if !found {
+		return nil
+	}
+	return rest
+}
+
+func hasPrefixFold(data []byte, prefix string) bool {
+	return len(data) >= len(prefix) && bytes.EqualFold(data[:len(prefix)], []byte(prefix))
+}
+
+// mediaType returns the lowercase media type of a Content-Type header, without parameters
+func mediaType(contentType string) string {
+	value, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// ImageFormatOf reconciles the Content-Type declared by the origin with the magic
+// bytes of the image. The detected format wins, as origins often send images as
+// application/octet-stream or with the type of another format. The declared type
+// is only used when the content is not recognized.
+func ImageFormatOf(contentType string, data []byte) string {
+	if detected := DetectImageFormat(data); detected != "" {
+		return detected
+	}
+	return mediaType(contentType)
+}
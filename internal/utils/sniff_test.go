@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+// pngChunk returns a PNG chunk with a zeroed CRC, which the sniffing does not check
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+// ftypBox returns an ISO BMFF file type box with the major and compatible brands
+func ftypBox(majorBrand string, compatibleBrands ...string) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(16+4*len(compatibleBrands)))
+	box = append(box, "ftyp"+majorBrand+"\x00\x00\x00\x00"...)
+	for _, brand := range compatibleBrands {
+		box = append(box, brand...)
+	}
+	return append(box, "\x00\x00\x00\x08meta"...)
+}
+
+// bmpHeader returns a BMP file header followed by the size of the DIB header
+func bmpHeader(dibHeaderSize uint32) []byte {
+	header := append([]byte("BM"), make([]byte, 12)...)
+	header = binary.LittleEndian.AppendUint32(header, dibHeaderSize)
+	return append(header, make([]byte, 8)...)
+}
+
+func TestDetectImageFormat(t *testing.T) {
+	pngSignature := "\x89PNG\x0d\x0a\x1a\x0a"
+	ihdr := pngChunk("IHDR", make([]byte, 13))
+	idat := pngChunk("IDAT", []byte{1, 2, 3})
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "PNG", data: slices.Concat([]byte(pngSignature), ihdr, idat), want: "image/png"},
+		{name: "APNG", data: slices.Concat([]byte(pngSignature), ihdr, pngChunk("acTL", make([]byte, 8)), idat), want: "image/apng"},
+		{name: "acTL after the image data", data: slices.Concat([]byte(pngSignature), ihdr, idat, pngChunk("acTL", make([]byte, 8))), want: "image/png"},
+		{name: "truncated PNG", data: slices.Concat([]byte(pngSignature), ihdr[:10]), want: "image/png"},
+		{name: "AVIF", data: ftypBox("avif", "mif1", "miaf"), want: "image/avif"},
+		{name: "AVIF sequence", data: ftypBox("avis", "msf1"), want: "image/avif"},
+		{name: "AVIF compatible brand", data: ftypBox("mif1", "avif"), want: "image/avif"},
+		{name: "HEIC", data: ftypBox("heic", "mif1"), want: "image/heif"},
+		{name: "HEIF", data: ftypBox("mif1", "heic"), want: "image/heif"},
+		{name: "MP4", data: ftypBox("isom", "mp41"), want: ""},
+		{name: "WebP", data: []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), want: "image/webp"},
+		{name: "WAV", data: []byte("RIFF\x24\x00\x00\x00WAVEfmt "), want: ""},
+		{name: "JPEG", data: []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), want: "image/jpeg"},
+		{name: "GIF", data: []byte("GIF89a\x01\x00\x01\x00"), want: "image/gif"},
+		{name: "BMP", data: bmpHeader(40), want: "image/bmp"},
+		{name: "BMP with a V5 header", data: bmpHeader(124), want: "image/bmp"},
+		{name: "text starting with BM", data: []byte("BMW owners club, annual meeting minutes"), want: ""},
+		{name: "short text starting with BM", data: []byte("BM"), want: ""},
+		{name: "PPM", data: []byte("P6\n1 1\n255\n\x00\x00\x00"), want: "image/x-portable-anymap"},
+		{name: "text starting with P", data: []byte("Page not found"), want: ""},
+		{name: "SVG", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), want: "image/svg+xml"},
+		{name: "SVG with a declaration and a BOM", data: []byte("\xef\xbb\xbf\n<?xml version=\"1.0\"?>\n<!DOCTYPE svg>\n<SVG></SVG>"), want: "image/svg+xml"},
+		{name: "SVG with comments and an SVG doctype", data: []byte("<?xml version=\"1.0\"?>\n<!-- Generator: Editor -->\n<!DOCTYPE svg PUBLIC \"-//W3C//DTD SVG 1.1//EN\" \"http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd\">\n<svg\n  width=\"10\"></svg>"), want: "image/svg+xml"},
+		{name: "HTML", data: []byte("<!DOCTYPE html><html><body>Not found</body></html>"), want: ""},
+		{name: "HTML with an inline svg", data: []byte(`<!DOCTYPE html><html><body><svg viewBox="0 0 10 10"><path d="M0 0h10"/></svg></body></html>`), want: ""},
+		{name: "HTML without a doctype with an inline svg", data: []byte(`<html><svg></svg></html>`), want: ""},
+		{name: "XML whose root is not svg", data: []byte(`<?xml version="1.0"?><feed><svg/></feed>`), want: ""},
+		{name: "element starting with svg", data: []byte(`<svgfoo></svgfoo>`), want: ""},
+		{name: "unterminated comment", data: []byte(`<!-- <svg>`), want: ""},
+		{name: "text mentioning svg", data: []byte("use <svg> elements for icons"), want: ""},
+		{name: "empty", data: nil, want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DetectImageFormat(test.data); got != test.want {
+				t.Errorf("DetectImageFormat(%q) = %q, want %q", test.data, got, test.want)
+			}
+		})
+	}
+}
+
+func TestImageFormatOf(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		want        string
+	}{
+		{name: "detected format wins", contentType: "application/octet-stream", data: []byte("GIF89a"), want: "image/gif"},
+		{name: "declared type of another format", contentType: "image/png", data: []byte("\xff\xd8\xff\xdb"), want: "image/jpeg"},
+		{name: "unrecognized content", contentType: "Text/HTML; charset=utf-8", data: []byte("<html></html>"), want: "text/html"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ImageFormatOf(test.contentType, test.data); got != test.want {
+				t.Errorf("ImageFormatOf(%q, %q) = %q, want %q", test.contentType, test.data, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"image/png"
+	"strconv"
+	"time"
+
+	"github.com/energypatrikhu/bandwidth-hero-proxy-go/third_party/vips"
+)
+
+const (
+	// ssimSize is the longest side of the planes compared, larger images are
+	// downscaled first so the score costs the same for every image
+	ssimSize = 512
+	// ssimWindow and ssimStride are the size and spacing of the compared windows
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// lumaPlane is the grayscale pixels of an image, row by row
+type lumaPlane struct {
+	Width, Height int
+	Pixels        []float64
+}
+
+func parseSsimTarget(target string) (float64, []error) {
+	if target == "" {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseFloat(target, 64)
+	if err != nil || parsed <= 0 || parsed >= 1 {
+		return 0, []error{fmt.Errorf("BHP_SSIM_TARGET: must be a number between 0 and 1, got %q", target)}
+	}
+	return parsed, nil
+}
+
+var ssimTarget, ssimTargetErrors = parseSsimTarget(BHP_SSIM_TARGET)
+
+func ssimErrors() []error {
+	errs := append([]error{}, ssimTargetErrors...)
+	if budget, err := time.ParseDuration(BHP_SSIM_TIME_BUDGET); err != nil || budget <= 0 {
+		errs = append(errs, fmt.Errorf("BHP_SSIM_TIME_BUDGET: invalid duration %q", BHP_SSIM_TIME_BUDGET))
+	}
+	return errs
+}
+
+// SsimTargetFor returns the SSIM the output must reach: the client's ssim parameter,
+// otherwise BHP_SSIM_TARGET, 0 when quality is not chosen by SSIM
+func SsimTargetFor(params *BhpParams) float64 {
+	if params.Ssim > 0 {
+		return params.Ssim
+	}
+	return ssimTarget
+}
+
+// newLumaPlane reads the luma of the image, downscaled to ssimSize, through an
+// uncompressed PNG. The image is not modified.
+func newLumaPlane(vipsImage *vips.Image) (*lumaPlane, error) {
+	plane, err := vipsImage.Copy(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy image: %w", err)
+	}
+	defer plane.Close()
+
+	if err := plane.ThumbnailImage(ssimSize, &vips.ThumbnailImageOptions{
+		Height: ssimSize,
+		Size:   vips.SizeDown,
+		Crop:   vips.InterestingNone,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to downscale image: %w", err)
+	}
+	if err := plane.Colourspace(vips.InterpretationBW, nil); err != nil {
+		return nil, fmt.Errorf("failed to convert image to grayscale: %w", err)
+	}
+
+	pngBytes, err := plane.PngsaveBuffer(&vips.PngsaveBufferOptions{
+		Compression: 0,
+		Keep:        vips.KeepNone,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to export image pixels: %w", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(pngBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image pixels: %w", err)
+	}
+
+	bounds := decoded.Bounds()
+	luma := &lumaPlane{Width: bounds.Dx(), Height: bounds.Dy(), Pixels: make([]float64, 0, bounds.Dx()*bounds.Dy())}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			luma.Pixels = append(luma.Pixels, float64(color.GrayModel.Convert(decoded.At(x, y)).(color.Gray).Y))
+		}
+	}
+	return luma, nil
+}
+
+// encodedLumaPlane decodes an encoded image and reads its luma like newLumaPlane
+func encodedLumaPlane(imageBytes []byte) (*lumaPlane, error) {
+	vipsImage, err := vips.NewImageFromBuffer(imageBytes, &vips.LoadOptions{FailOnError: false})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode compressed image: %w", err)
+	}
+	defer vipsImage.Close()
+	return newLumaPlane(vipsImage)
+}
+
+// ssim returns the mean structural similarity of the windows of two planes of the same size
+func ssim(reference *lumaPlane, candidate *lumaPlane) (float64, error) {
+	if reference.Width != candidate.Width || reference.Height != candidate.Height {
+		return 0, fmt.Errorf("compressed image is %dx%d instead of %dx%d", candidate.Width, candidate.Height, reference.Width, reference.Height)
+	}
+
+	const c1, c2 = (0.01 * 255) * (0.01 * 255), (0.03 * 255) * (0.03 * 255)
+	window := min(ssimWindow, reference.Width, reference.Height)
+	if window == 0 {
+		return 1, nil
+	}
+	count := float64(window * window)
+
+	total, windows := 0.0, 0
+	for top := 0; top+window <= reference.Height; top += ssimStride {
+		for left := 0; left+window <= reference.Width; left += ssimStride {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := top; y < top+window; y++ {
+				row := y * reference.Width
+				for x := left; x < left+window; x++ {
+					a, b := reference.Pixels[row+x], candidate.Pixels[row+x]
+					sumA += a
+					sumB += b
+					sumAA += a * a
+					sumBB += b * b
+					sumAB += a * b
+				}
+			}
+
+			meanA, meanB := sumA/count, sumB/count
+			varianceA := sumAA/count - meanA*meanA
+			varianceB := sumBB/count - meanB*meanB
+			covariance := sumAB/count - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*covariance + c2)) / ((meanA*meanA + meanB*meanB + c1) * (varianceA + varianceB + c2))
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
+
+// encodeWithSsim encodes the image and scores it against the reference plane
+func encodeWithSsim(vipsImage *vips.Image, reference *lumaPlane, format string, quality int) (*CompressImageResult, error) {
+	compressedImageBytes, err := encodeImage(vipsImage, format, quality)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := encodedLumaPlane(compressedImageBytes)
+	if err != nil {
+		return nil, err
+	}
+	score, err := ssim(reference, candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	result := newCompressImageResult(compressedImageBytes, format, quality)
+	result.Ssim = score
+	return result, nil
+}
+
+// searchSsimQuality binary searches the lowest quality, from BHP_AUTO_QUALITY_MIN up to
+// the initial one, whose output reaches the target SSIM. When the deadline passes
+// first, the lowest quality found so far is used. When none reaches the target, the
+// initial quality is used.
+func searchSsimQuality(vipsImage *vips.Image, reference *lumaPlane, format string, initialQuality int, target float64, deadline time.Time) (*CompressImageResult, error) {
+	var best *CompressImageResult
+	low, high := min(BHP_AUTO_QUALITY_MIN, initialQuality), initialQuality
+	for low <= high && time.Now().Before(deadline) {
+		quality := (low + high) / 2
+		result, err := encodeWithSsim(vipsImage, reference, format, quality)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Ssim >= target {
+			best = result
+			high = quality - 1
+		} else {
+			low = quality + 1
+		}
+	}
+
+	if best == nil {
+		return encodeWithSsim(vipsImage, reference, format, initialQuality)
+	}
+	return best, nil
+}
+
+// preferSsimResult reports whether the candidate beats the current best: outputs
+// reaching the target SSIM win over those that do not, then the smallest wins
+func preferSsimResult(best *CompressImageResult, candidate *CompressImageResult, target float64) bool {
+	if best == nil {
+		return true
+	}
+	if (candidate.Ssim >= target) != (best.Ssim >= target) {
+		return candidate.Ssim >= target
+	}
+	return len(candidate.Bytes) < len(best.Bytes)
+}
+
+// CompressImageToSsim decodes the image once and, for each format, searches the
+// lowest quality that reaches the target SSIM within BHP_SSIM_TIME_BUDGET,
+// returning the smallest output that reaches it, or the smallest one when none does
+func CompressImageToSsim(imageBytes []byte, options CompressImageToSsimOptions) (*CompressImageResult, int, error) {
+	budget, err := time.ParseDuration(BHP_SSIM_TIME_BUDGET)
+	if err != nil {
+		budget = 0
+	}
+	deadline := time.Now().Add(budget)
+
+	vipsImage, err := loadImage(imageBytes, CompressImageOptions{
+		InputFormat: options.InputFormat,
+		Grayscale:   options.Grayscale,
+		Resize:      options.Resize,
+	})
+	if err != nil {
+		return nil, options.InitialQuality, fmt.Errorf("failed to compress image: %w", err)
+	}
+	defer vipsImage.Close()
+
+	reference, err := newLumaPlane(vipsImage)
+	if err != nil {
+		return nil, options.InitialQuality, fmt.Errorf("failed to compress image: %w", err)
+	}
+
+	var best *CompressImageResult
+	for _, format := range options.Formats {
+		var result *CompressImageResult
+		if qualityFormats[format] {
+			result, err = searchSsimQuality(vipsImage, reference, format, options.InitialQuality, options.Target, deadline)
+		} else {
+			result, err = encodeWithSsim(vipsImage, reference, format, options.InitialQuality)
+		}
+		if err != nil {
+			return nil, options.InitialQuality, fmt.Errorf("failed to compress image to %s: %w", format, err)
+		}
+
+		if preferSsimResult(best, result, options.Target) {
+			best = result
+		}
+	}
+
+	if best == nil {
+		return nil, options.InitialQuality, fmt.Errorf("no output format to compress image to")
+	}
+	return best, best.Quality, nil
+}
@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestPlane returns a plane whose pixels are given by value(x, y)
+func newTestPlane(width int, height int, value func(x, y int) float64) *lumaPlane {
+	plane := &lumaPlane{Width: width, Height: height}
+	for y := range height {
+		for x := range width {
+			plane.Pixels = append(plane.Pixels, value(x, y))
+		}
+	}
+	return plane
+}
+
+func TestSsim(t *testing.T) {
+	gradient := func(x, y int) float64 { return float64(x*7+y*5) + 20 }
+	reference := newTestPlane(32, 32, gradient)
+	checkerboard := func(amplitude float64) func(x, y int) float64 {
+		return func(x, y int) float64 {
+			if (x+y)%2 == 0 {
+				return gradient(x, y) + amplitude
+			}
+			return gradient(x, y) - amplitude
+		}
+	}
+
+	tests := []struct {
+		name      string
+		reference *lumaPlane
+		candidate *lumaPlane
+		want      float64
+	}{
+		{name: "identical planes", reference: reference, candidate: newTestPlane(32, 32, gradient), want: 1},
+		{name: "identical flat planes", reference: newTestPlane(16, 16, func(x, y int) float64 { return 128 }), candidate: newTestPlane(16, 16, func(x, y int) float64 { return 128 }), want: 1},
+		// Only the luminance term differs for flat planes: (2*100*110 + c1) / (100² + 110² + c1)
+		{name: "brightened flat plane", reference: newTestPlane(16, 16, func(x, y int) float64 { return 100 }), candidate: newTestPlane(16, 16, func(x, y int) float64 { return 110 }), want: (22000 + 6.5025) / (22100 + 6.5025)},
+		{name: "smaller than a window", reference: newTestPlane(4, 4, gradient), candidate: newTestPlane(4, 4, gradient), want: 1},
+		{name: "empty planes", reference: &lumaPlane{}, candidate: &lumaPlane{}, want: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ssim(test.reference, test.candidate)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-test.want) > 1e-9 {
+				t.Errorf("ssim() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("degraded planes", func(t *testing.T) {
+		previous := 1.0
+		for _, amplitude := range []float64{2, 8, 32} {
+			got, err := ssim(reference, newTestPlane(32, 32, checkerboard(amplitude)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got <= 0 || got >= previous {
+				t.Errorf("ssim() with noise of %v = %v, want between 0 and %v", amplitude, got, previous)
+			}
+			previous = got
+		}
+	})
+
+	t.Run("different sizes", func(t *testing.T) {
+		if _, err := ssim(reference, newTestPlane(16, 32, gradient)); err == nil {
+			t.Error("ssim() of planes of different sizes succeeded, want an error")
+		}
+	})
+}
+
+func TestPreferSsimResult(t *testing.T) {
+	result := func(size int, score float64) *CompressImageResult {
+		return &CompressImageResult{Bytes: make([]byte, size), Ssim: score}
+	}
+
+	tests := []struct {
+		name      string
+		best      *CompressImageResult
+		candidate *CompressImageResult
+		want      bool
+	}{
+		{name: "first result", candidate: result(100, 0.5), want: true},
+		{name: "smaller, both reaching the target", best: result(100, 0.97), candidate: result(50, 0.96), want: true},
+		{name: "larger, both reaching the target", best: result(50, 0.97), candidate: result(100, 0.99), want: false},
+		{name: "smaller, below the target", best: result(100, 0.96), candidate: result(50, 0.9), want: false},
+		{name: "larger, reaching the target", best: result(50, 0.9), candidate: result(100, 0.95), want: true},
+		{name: "smaller, both below the target", best: result(100, 0.9), candidate: result(50, 0.8), want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := preferSsimResult(test.best, test.candidate, 0.95); got != test.want {
+				t.Errorf("preferSsimResult() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
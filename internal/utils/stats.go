@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StatsTotals are the aggregated sizes of the images served
+type StatsTotals struct {
+	Requests        int64 `json:"requests"`
+	OriginalBytes   int64 `json:"original_bytes"`
+	CompressedBytes int64 `json:"compressed_bytes"`
+	SavedBytes      int64 `json:"saved_bytes"`
+}
+
+func (totals *StatsTotals) add(other StatsTotals) {
+	totals.Requests += other.Requests
+	totals.OriginalBytes += other.OriginalBytes
+	totals.CompressedBytes += other.CompressedBytes
+	totals.SavedBytes += other.SavedBytes
+}
+
+type DomainStats struct {
+	Domain string `json:"domain"`
+	StatsTotals
+}
+
+// StatsReport is the response of the stats API
+type StatsReport struct {
+	From    string                  `json:"from"`
+	To      string                  `json:"to"`
+	Total   StatsTotals             `json:"total"`
+	Days    map[string]*StatsTotals `json:"days"`
+	Users   map[string]*StatsTotals `json:"users"`
+	Domains []DomainStats           `json:"domains"` // Sorted by saved bytes
+}
+
+// Usage is stored per day, client and domain, under "<day>\x00<client>\x00<domain>"
+var statsBucket = []byte("usage")
+
+var (
+	statsDb      *bolt.DB
+	statsMu      sync.Mutex
+	pendingStats = map[string]*StatsTotals{}
+)
+
+func statsKey(day string, client string, domain string) string {
+	return day + "\x00" + client + "\x00" + domain
+}
+
+// OpenStats opens the stats database at BHP_STATS_DB, stats are disabled when it is not set
+func OpenStats() error {
+	if BHP_STATS_DB == "" {
+		return nil
+	}
+
+	db, err := bolt.Open(BHP_STATS_DB, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open stats database: %v", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(statsBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to initialize stats database: %v", err)
+	}
+
+	statsDb = db
+	return pruneStats()
+}
+
+// CloseStats writes the pending stats and closes the database
+func CloseStats() {
+	if statsDb == nil {
+		return
+	}
+	if err := flushStats(); err != nil {
+		log.Println("Error:", err)
+	}
+	if err := statsDb.Close(); err != nil {
+		log.Println("Error closing stats database:", err)
+	}
+	statsDb = nil
+}
+
+// RecordStats adds a served image to the stats of the client and the domain of the image
+func RecordStats(r *http.Request, imageUrl string, originalSize int, compressedSize int) {
+	if statsDb == nil {
+		return
+	}
+
+	key := statsKey(utcDay(time.Now()), clientKey(ClientFromRequest(r)), imageDomain(imageUrl))
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	totals, exists := pendingStats[key]
+	if !exists {
+		totals = &StatsTotals{}
+		pendingStats[key] = totals
+	}
+	totals.add(StatsTotals{
+		Requests:        1,
+		OriginalBytes:   int64(originalSize),
+		CompressedBytes: int64(compressedSize),
+		SavedBytes:      int64(originalSize - compressedSize),
+	})
+}
+
+// flushStats adds the pending stats to the database in a single transaction,
+// so served images do not wait for the disk
+func flushStats() error {
+	statsMu.Lock()
+	pending := pendingStats
+	pendingStats = map[string]*StatsTotals{}
+	statsMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := statsDb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+		for key, totals := range pending {
+			var stored StatsTotals
+			if value := bucket.Get([]byte(key)); value != nil {
+				if err := json.Unmarshal(value, &stored); err != nil {
+					return err
+				}
+			}
+			stored.add(*totals)
+
+			value, err := json.Marshal(stored)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save stats: %v", err)
+	}
+	return nil
+}
+
+// pruneStats removes the days older than BHP_STATS_RETENTION_DAYS
+func pruneStats() error {
+	if BHP_STATS_RETENTION_DAYS <= 0 {
+		return nil
+	}
+
+	cutoff := []byte(utcDay(time.Now().AddDate(0, 0, -BHP_STATS_RETENTION_DAYS)))
+	err := statsDb.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(statsBucket)
+
+		// Deleting while iterating would skip keys, collect them first
+		var expired [][]byte
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key, cutoff) < 0; key, _ = cursor.Next() {
+			expired = append(expired, bytes.Clone(key))
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to prune stats: %v", err)
+	}
+	return nil
+}
+
+// RunStats saves the pending stats every 10 seconds and prunes old days
+// hourly, until ctx is done
+func RunStats(ctx context.Context) {
+	if statsDb == nil {
+		return
+	}
+
+	flushTicker := time.NewTicker(10 * time.Second)
+	defer flushTicker.Stop()
+	pruneTicker := time.NewTicker(time.Hour)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-flushTicker.C:
+			if err := flushStats(); err != nil {
+				log.Println("Error:", err)
+			}
+		case <-pruneTicker.C:
+			if err := pruneStats(); err != nil {
+				log.Println("Error:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// QueryStats aggregates the stats between the from and to days (inclusive),
+// only of the given client when it is not empty
+func QueryStats(from string, to string, client string, domainLimit int) (*StatsReport, error) {
+	if err := flushStats(); err != nil {
+		return nil, err
+	}
+
+	report := &StatsReport{
+		From:  from,
+		To:    to,
+		Days:  map[string]*StatsTotals{},
+		Users: map[string]*StatsTotals{},
+	}
+	domains := map[string]*StatsTotals{}
+
+	err := statsDb.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(statsBucket).Cursor()
+		for key, value := cursor.Seek([]byte(from)); key != nil; key, value = cursor.Next() {
+			day, rest, _ := strings.Cut(string(key), "\x00")
+			if day > to {
+				break
+			}
+			keyClient, domain, _ := strings.Cut(rest, "\x00")
+			if client != "" && keyClient != client {
+				continue
+			}
+
+			var totals StatsTotals
+			if err := json.Unmarshal(value, &totals); err != nil {
+				return err
+			}
+
+			report.Total.add(totals)
+			for _, group := range []struct {
+				totals map[string]*StatsTotals
+				key    string
+			}{{report.Days, day}, {report.Users, keyClient}, {domains, domain}} {
+				if group.totals[group.key] == nil {
+					group.totals[group.key] = &StatsTotals{}
+				}
+				group.totals[group.key].add(totals)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stats: %v", err)
+	}
+
+	report.Domains = make([]DomainStats, 0, len(domains))
+	for domain, totals := range domains {
+		report.Domains = append(report.Domains, DomainStats{Domain: domain, StatsTotals: *totals})
+	}
+	sort.Slice(report.Domains, func(i, j int) bool {
+		if report.Domains[i].SavedBytes != report.Domains[j].SavedBytes {
+			return report.Domains[i].SavedBytes > report.Domains[j].SavedBytes
+		}
+		return report.Domains[i].Domain < report.Domains[j].Domain
+	})
+	if domainLimit > 0 && len(report.Domains) > domainLimit {
+		report.Domains = report.Domains[:domainLimit]
+	}
+
+	return report, nil
+}
+
+// StatsHandler serves the savings of the current month, or of the days given by
+// the "month" (YYYY-MM) or "from" and "to" (YYYY-MM-DD) query parameters.
+// Authenticated clients only see their own stats, unless they are admins.
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	now := time.Now().UTC()
+	from := now.Format("2006-01") + "-01"
+	to := utcDay(now)
+
+	if month := query.Get("month"); month != "" {
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		from = utcDay(start)
+		to = utcDay(start.AddDate(0, 1, -1))
+	}
+	for name, day := range map[string]*string{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				http.Error(w, "Invalid "+name+" day, expected YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+			*day = value
+		}
+	}
+
+	// Only admins may see other clients, or every client at once
+	client := clientKey(ClientFromRequest(r))
+	if IsAdmin(r) {
+		client = query.Get("user")
+	}
+
+	domainLimit := 20
+	if limit := query.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		domainLimit = parsed
+	}
+
+	report, err := QueryStats(from, to, client, domainLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Println("Error:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Println("Error writing stats response:", err)
+	}
+}
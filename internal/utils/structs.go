@@ -1,25 +1,48 @@
 package utils
 
 import (
+	"bytes"
+	"io"
 	"net/http"
 )
 
 type BhpParams struct {
-	Url       string `json:"url"`
-	Format    string `json:"format"`
-	Grayscale bool   `json:"grayscale"`
-	Quality   int    `json:"quality"`
+	Url         string        `json:"url"`
+	Format      string        `json:"format"` // Empty keeps the input format when it can be encoded
+	Grayscale   bool          `json:"grayscale"`
+	Quality     int           `json:"quality"`
+	Resize      ResizeOptions `json:"resize"`
+	ForceFormat bool          `json:"forceFormat"` // Serve the output even if it is bigger, like BHP_FORCE_FORMAT
+	Ssim        float64       `json:"ssim"`        // Target SSIM overriding BHP_SSIM_TARGET, 0 for none
+	Formats     []string      `json:"formats"`     // Best format candidates the client accepts, empty for all
+}
+
+type ResizeOptions struct {
+	Width   int    `json:"width"`  // 0 keeps the aspect ratio based on Height
+	Height  int    `json:"height"` // 0 keeps the aspect ratio based on Width
+	Type    string `json:"type"`   // fit, fill, fill-down, force, auto or outside
+	Enlarge bool   `json:"enlarge"`
+	Gravity string `json:"gravity"` // ce, no, so, ea, we, noea, nowe, soea, sowe or sm (smart)
 }
 
 type ImageResponse struct {
 	Bytes           []byte
 	RequestHeaders  map[string]string
 	ResponseHeaders http.Header
+	Proto           string // HTTP version of the origin response, e.g. "HTTP/1.1"
+	NotModified     bool   // The image still matches the validators of a conditional request
+	StatusCode      int
+	Body            io.ReadCloser // Set instead of Bytes when the origin did not send an image, decoded and must be closed
+	buffer          *bytes.Buffer // Pooled memory behind Bytes, see Release
+	wire            *countingReader
 }
 
 type CompressImageResult struct {
-	Bytes  []byte
-	Format string
+	Bytes    []byte
+	Format   string
+	Quality  int     // 0 for formats without a quality setting
+	Ssim     float64 // Score against the original, when the quality was chosen by SSIM
+	Animated bool    // Every frame of an animated image was kept
 }
 
 type CompressImageOptions struct {
@@ -28,18 +51,34 @@ type CompressImageOptions struct {
 	Format      string
 	Grayscale   bool
 	Quality     int
+	Resize      ResizeOptions
 }
 
-type CompressImageWithAutoQualityDecrementOptions struct {
+type CompressImageWithQualitySearchOptions struct {
 	InputFormat       string
+	IsAnimated        bool
 	Format            string
 	Grayscale         bool
 	InitialQuality    int
 	OriginalImageSize int
+	Resize            ResizeOptions
+}
+
+type CompressImageToSsimOptions struct {
+	InputFormat    string
+	Formats        []string // Candidates, the smallest output wins
+	Grayscale      bool
+	InitialQuality int
+	Target         float64
+	Resize         ResizeOptions
 }
 
 type CompressImageToBestFormatOptions struct {
-	InputFormat string
-	Grayscale   bool
-	Quality     int
+	InputFormat   string
+	IsAnimated    bool
+	Formats       []string // Candidates, the smallest output wins
+	SearchQuality bool     // Search the quality of each candidate, like CompressImageWithQualitySearch
+	Grayscale     bool
+	Quality       int
+	Resize        ResizeOptions
 }
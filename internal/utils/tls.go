@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certificateReloadInterval is how often the certificate files are checked for changes
+const certificateReloadInterval = 10 * time.Second
+
+func TlsEnabled() bool {
+	return BHP_TLS_CERT != "" || BHP_TLS_KEY != ""
+}
+
+// parseCipherSuites maps cipher suite names (as in crypto/tls) to their IDs,
+// insecure suites are rejected
+func parseCipherSuites(names []string) ([]uint16, []error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	var errs []error
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("BHP_TLS_CIPHER_SUITES: unknown or insecure cipher suite %q", name))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, errs
+}
+
+func tlsErrors() []error {
+	var errs []error
+
+	if (BHP_TLS_CERT == "") != (BHP_TLS_KEY == "") {
+		errs = append(errs, fmt.Errorf("BHP_TLS_CERT and BHP_TLS_KEY must be set together"))
+	}
+	if _, ok := tlsVersions[BHP_TLS_MIN_VERSION]; !ok {
+		errs = append(errs, fmt.Errorf("BHP_TLS_MIN_VERSION: must be 1.0, 1.1, 1.2 or 1.3, got %q", BHP_TLS_MIN_VERSION))
+	}
+	_, cipherErrs := parseCipherSuites(BHP_TLS_CIPHER_SUITES)
+	errs = append(errs, cipherErrs...)
+	if BHP_H2C && TlsEnabled() {
+		errs = append(errs, fmt.Errorf("BHP_H2C only applies to plaintext HTTP, it cannot be used with BHP_TLS_CERT"))
+	}
+
+	return errs
+}
+
+// certificateReloader serves the certificate from BHP_TLS_CERT and BHP_TLS_KEY,
+// and reloads it when the files change
+type certificateReloader struct {
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func (reloader *certificateReloader) load() error {
+	certInfo, err := os.Stat(BHP_TLS_CERT)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(BHP_TLS_KEY)
+	if err != nil {
+		return fmt.Errorf("failed to read TLS key: %v", err)
+	}
+
+	reloader.mu.RLock()
+	unchanged := reloader.certificate != nil && certInfo.ModTime().Equal(reloader.certModTime) && keyInfo.ModTime().Equal(reloader.keyModTime)
+	reloader.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(BHP_TLS_CERT, BHP_TLS_KEY)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloaded := reloader.certificate != nil
+	reloader.certificate = &certificate
+	reloader.certModTime = certInfo.ModTime()
+	reloader.keyModTime = keyInfo.ModTime()
+
+	if reloaded {
+		log.Println("Info: TLS certificate reloaded")
+	}
+	return nil
+}
+
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.certificate, nil
+}
+
+// watch reloads the certificate when its files change, until ctx is done.
+// The previous certificate is kept when the new files cannot be loaded,
+// e.g. while only one of them was replaced.
+func (reloader *certificateReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certificateReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := reloader.load(); err != nil {
+				log.Println("Error:", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// TlsConfig loads the certificate and returns the TLS configuration of the
+// server, the certificate is reloaded on change until ctx is done
+func TlsConfig(ctx context.Context) (*tls.Config, error) {
+	reloader := &certificateReloader{}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	go reloader.watch(ctx)
+
+	cipherSuites, _ := parseCipherSuites(BHP_TLS_CIPHER_SUITES)
+	return &tls.Config{
+		MinVersion:     tlsVersions[BHP_TLS_MIN_VERSION],
+		CipherSuites:   cipherSuites, // Only used up to TLS 1.2, TLS 1.3 suites are not configurable
+		GetCertificate: reloader.getCertificate,
+	}, nil
+}
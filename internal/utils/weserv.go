@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var weservFits = map[string]string{
+	"inside":  "fit",
+	"contain": "fit", // Letterboxing is not supported, the image is fitted instead
+	"outside": "outside",
+	"cover":   "fill",
+	"fill":    "force",
+}
+
+var weservAlignments = map[string]string{
+	"center":       "ce",
+	"centre":       "ce",
+	"top":          "no",
+	"t":            "no",
+	"bottom":       "so",
+	"b":            "so",
+	"left":         "we",
+	"l":            "we",
+	"right":        "ea",
+	"r":            "ea",
+	"top-left":     "nowe",
+	"top-right":    "noea",
+	"bottom-left":  "sowe",
+	"bottom-right": "soea",
+	"entropy":      "sm",
+	"attention":    "sm",
+}
+
+var weservOutputs = map[string]string{
+	"jpg":  "jpeg",
+	"jpeg": "jpeg",
+	"png":  "png",
+	"gif":  "gif",
+	"webp": "webp",
+	"avif": "avif",
+}
+
+// weservError is the JSON error body of the images.weserv.nl API
+type weservError struct {
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeWeservError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(weservError{Status: "error", Code: status, Message: message}); err != nil {
+		log.Println("Error writing weserv error response:", err)
+	}
+}
+
+// weservResponder answers with a weserv JSON error, or redirects to the
+// default image when the request has a "default" parameter
+func weservResponder(defaultUrl string) ErrorResponder {
+	if defaultUrl != "" {
+		return ErrorResponder{
+			Action: "Redirecting to default image",
+			Respond: func(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, err error) {
+				w.Header().Set("Location", defaultUrl)
+				w.WriteHeader(http.StatusFound)
+			},
+		}
+	}
+
+	return ErrorResponder{
+		Action: "Responding with weserv error",
+		Respond: func(w http.ResponseWriter, r *http.Request, bhpParams *BhpParams, status int, err error) {
+			writeWeservError(w, status, err.Error())
+		},
+	}
+}
+
+// WeservHandler handles images.weserv.nl style requests (?url=...&w=&h=&fit=&output=&q=&filt=greyscale)
+func WeservHandler(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsigned(w, r) {
+		return
+	}
+
+	bhpParams, defaultUrl, err := ParseWeservParams(r.URL.Query())
+	if err != nil {
+		if defaultUrl != "" {
+			w.Header().Set("Location", defaultUrl)
+			w.WriteHeader(http.StatusFound)
+		} else {
+			writeWeservError(w, http.StatusBadRequest, err.Error())
+		}
+		RecordFailure("Invalid weserv query", weservResponder(defaultUrl).Action)
+		log.Printf("\n> Weserv query: %s\n> Info:\n > Error: %s\n", r.URL.RawQuery, err.Error())
+		return
+	}
+
+	ServeImage(w, r, bhpParams, weservResponder(defaultUrl))
+}
+
+// ParseWeservParams maps the weserv query vocabulary onto BhpParams. Like weserv,
+// invalid or unsupported values of optional parameters are ignored.
+// The second return value is the image to redirect to on errors, if requested.
+func ParseWeservParams(query url.Values) (*BhpParams, string, error) {
+	sourceUrl := normalizeWeservUrl(query.Get("url"))
+
+	defaultUrl := query.Get("default")
+	if defaultUrl != "" {
+		if defaultUrl == "1" || defaultUrl == "true" {
+			defaultUrl = sourceUrl
+		} else {
+			defaultUrl = normalizeWeservUrl(defaultUrl)
+		}
+	}
+
+	if sourceUrl == "" {
+		return nil, defaultUrl, fmt.Errorf("image URL is missing or invalid")
+	}
+
+	bhpParams := &BhpParams{
+		Url:         sourceUrl,
+		Quality:     80,
+		ForceFormat: true, // weserv always serves the processed image
+		Resize: ResizeOptions{
+			Type:    "fit",
+			Enlarge: true,
+		},
+	}
+
+	bhpParams.Resize.Width = parseWeservInt(query.Get("w"), 1, maxDimension)
+	bhpParams.Resize.Height = parseWeservInt(query.Get("h"), 1, maxDimension)
+	if dpr, err := strconv.ParseFloat(query.Get("dpr"), 64); err == nil && dpr >= 1 && dpr <= 8 {
+		bhpParams.Resize.Width = int(float64(bhpParams.Resize.Width) * dpr)
+		bhpParams.Resize.Height = int(float64(bhpParams.Resize.Height) * dpr)
+	}
+
+	if resizeType, ok := weservFits[query.Get("fit")]; ok {
+		bhpParams.Resize.Type = resizeType
+	}
+	if gravity, ok := weservAlignments[query.Get("a")]; ok {
+		bhpParams.Resize.Gravity = gravity
+	}
+	if _, withoutEnlargement := query["we"]; withoutEnlargement {
+		bhpParams.Resize.Enlarge = false
+	}
+
+	if output := query.Get("output"); output != "" {
+		format, ok := weservOutputs[output]
+		if !ok {
+			return nil, defaultUrl, fmt.Errorf("unsupported output format: %s", output)
+		}
+		bhpParams.Format = format
+	}
+
+	if quality := parseWeservInt(query.Get("q"), 1, 100); quality > 0 {
+		bhpParams.Quality = quality
+	}
+
+	if filter := query.Get("filt"); filter == "greyscale" || filter == "grayscale" {
+		bhpParams.Grayscale = true
+	}
+
+	return bhpParams, defaultUrl, nil
+}
+
+// normalizeWeservUrl accepts URLs without a scheme and the "ssl:" prefix, like weserv does
+func normalizeWeservUrl(rawUrl string) string {
+	rawUrl = strings.TrimSpace(rawUrl)
+	switch {
+	case rawUrl == "":
+		return ""
+	case strings.HasPrefix(rawUrl, "ssl:"):
+		return "https://" + strings.TrimLeft(strings.TrimPrefix(rawUrl, "ssl:"), "/")
+	case strings.HasPrefix(rawUrl, "//"):
+		return "http:" + rawUrl
+	case !strings.HasPrefix(rawUrl, "http://") && !strings.HasPrefix(rawUrl, "https://"):
+		return "http://" + rawUrl
+	}
+	return rawUrl
+}
+
+func parseWeservInt(value string, minValue int, maxValue int) int {
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < minValue || parsed > maxValue {
+		return 0
+	}
+	return parsed
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseWeservParams(t *testing.T) {
+	defaultResize := ResizeOptions{Type: "fit", Enlarge: true}
+
+	tests := []struct {
+		name        string
+		query       string
+		want        BhpParams
+		wantDefault string
+		wantErr     bool
+	}{
+		{
+			name:  "URL without scheme",
+			query: "url=example.com/cat.jpg",
+			want:  BhpParams{Url: "http://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: defaultResize},
+		},
+		{
+			name:  "ssl prefix",
+			query: "url=ssl:example.com/cat.jpg",
+			want:  BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: defaultResize},
+		},
+		{
+			name:  "resize, output, quality and filter",
+			query: "url=https://example.com/cat.jpg&w=300&h=200&fit=cover&a=attention&output=jpg&q=60&filt=greyscale",
+			want: BhpParams{Url: "https://example.com/cat.jpg", Format: "jpeg", Quality: 60, Grayscale: true, ForceFormat: true,
+				Resize: ResizeOptions{Type: "fill", Width: 300, Height: 200, Enlarge: true, Gravity: "sm"}},
+		},
+		{
+			name:  "dpr before the size",
+			query: "dpr=2&url=https://example.com/cat.jpg&w=300&we",
+			want:  BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: ResizeOptions{Type: "fit", Width: 600}},
+		},
+		{
+			name:  "invalid optional values are ignored",
+			query: "url=https://example.com/cat.jpg&w=-1&h=abc&dpr=20&q=101&fit=crop&a=middle&filt=sepia",
+			want:  BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: defaultResize},
+		},
+		{
+			name:        "default redirects to the original",
+			query:       "url=https://example.com/cat.jpg&default=1",
+			want:        BhpParams{Url: "https://example.com/cat.jpg", Quality: 80, ForceFormat: true, Resize: defaultResize},
+			wantDefault: "https://example.com/cat.jpg",
+		},
+		{name: "missing URL", query: "w=300&default=example.com/fallback.png", wantDefault: "http://example.com/fallback.png", wantErr: true},
+		{name: "unsupported output", query: "url=https://example.com/cat.jpg&output=tiff", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bhpParams, defaultUrl, err := ParseWeservParams(query)
+			if defaultUrl != test.wantDefault {
+				t.Errorf("ParseWeservParams(%q) default = %q, want %q", test.query, defaultUrl, test.wantDefault)
+			}
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("ParseWeservParams(%q) = %+v, want an error", test.query, bhpParams)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWeservParams(%q) error: %v", test.query, err)
+			}
+			if !reflect.DeepEqual(*bhpParams, test.want) {
+				t.Errorf("ParseWeservParams(%q) = %+v, want %+v", test.query, *bhpParams, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package urlsigning
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "sorted by name", query: "url=https%3A%2F%2Fexample.com%2Fcat.jpg&l=40&bw=1", want: "bw=1&l=40&url=https%3A%2F%2Fexample.com%2Fcat.jpg"},
+		{name: "signature excluded", query: "sig=abc&url=x&exp=10", want: "exp=10&url=x"},
+		{name: "repeated values keep their order", query: "b=2&a=3&b=1", want: "a=3&b=2&b=1"},
+		{name: "empty", query: "", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			params, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Canonical(params); got != test.want {
+				t.Errorf("Canonical(%q) = %q, want %q", test.query, got, test.want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	oldKey, newKey := []byte("old-key-0123456789"), []byte("new-key-0123456789")
+	params := url.Values{"url": {"https://example.com/cat.jpg"}, "l": {"40"}}
+
+	tampered := Sign(params, newKey, time.Time{})
+	tampered.Set("l", "90")
+	tamperedSig := Sign(params, newKey, time.Time{})
+	tamperedSig.Set(SignatureParam, tamperedSig.Get(SignatureParam)[1:]+"A")
+	extendedExpiry := Sign(params, newKey, now.Add(-time.Minute))
+	extendedExpiry.Set(ExpiresParam, "1800000000")
+
+	tests := []struct {
+		name    string
+		params  url.Values
+		keys    [][]byte
+		wantErr error
+	}{
+		{name: "valid", params: Sign(params, newKey, time.Time{}), keys: [][]byte{newKey}},
+		{name: "valid before expiry", params: Sign(params, newKey, now.Add(time.Hour)), keys: [][]byte{newKey}},
+		{name: "expired", params: Sign(params, newKey, now.Add(-time.Second)), keys: [][]byte{newKey}, wantErr: ErrExpired},
+		{name: "expires now", params: Sign(params, newKey, now), keys: [][]byte{newKey}, wantErr: ErrExpired},
+		{name: "extended expiry", params: extendedExpiry, keys: [][]byte{newKey}, wantErr: ErrInvalidSignature},
+		{name: "old key still accepted during rotation", params: Sign(params, oldKey, time.Time{}), keys: [][]byte{newKey, oldKey}},
+		{name: "removed key", params: Sign(params, oldKey, time.Time{}), keys: [][]byte{newKey}, wantErr: ErrInvalidSignature},
+		{name: "tampered parameter", params: tampered, keys: [][]byte{newKey}, wantErr: ErrInvalidSignature},
+		{name: "tampered signature", params: tamperedSig, keys: [][]byte{newKey}, wantErr: ErrInvalidSignature},
+		{name: "missing signature", params: params, keys: [][]byte{newKey}, wantErr: ErrMissingSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Verify(test.params, test.keys, now); !errors.Is(err, test.wantErr) {
+				t.Errorf("Verify(%q) = %v, want %v", test.params.Encode(), err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	signedUrl, err := SignURL("http://proxy.example/?url=https%3A%2F%2Fexample.com%2Fcat.jpg&l=40&sig=stale", key, time.Unix(1800000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedUrl, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsedUrl.Host != "proxy.example" || parsedUrl.Path != "/" {
+		t.Errorf("SignURL() = %q, changed the proxy URL", signedUrl)
+	}
+	if err := Verify(parsedUrl.Query(), [][]byte{key}, time.Unix(1700000000, 0)); err != nil {
+		t.Errorf("Verify(SignURL()) = %v", err)
+	}
+}